@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type readOnlyKey struct{}
+
+// readOnlyMode makes every mutating handler respond 503 Service Unavailable while reads keep
+// being served, e.g. during database maintenance. It is set from READ_ONLY at startup.
+var readOnlyMode bool
+
+// readOnly marks a handler as not modifying any state. Read-only requests may be served
+// from caches and, once one is configured, from a read replica.
+func readOnly(h http.HandlerFunc) http.HandlerFunc {
+	return withAccess(true, h)
+}
+
+// mutating marks a handler as modifying state. Mutating requests always go to the primary
+// database and their responses are never cached.
+func mutating(h http.HandlerFunc) http.HandlerFunc {
+	return withAccess(false, h)
+}
+
+func withAccess(ro bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ro {
+			w.Header().Set("Cache-Control", "no-store")
+			if readOnlyMode {
+				writeError(w, r, http.StatusServiceUnavailable, ErrReadOnlyMode)
+				return
+			}
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), readOnlyKey{}, ro)))
+	}
+}
+
+// isReadOnly reports whether the request was routed to a handler marked with readOnly.
+// Requests to unmarked handlers are treated as mutating.
+func isReadOnly(r *http.Request) bool {
+	ro, _ := r.Context().Value(readOnlyKey{}).(bool)
+	return ro
+}
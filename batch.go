@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BatchWriter buffers rows for one table and writes them with a single multi-row INSERT,
+// either every flush interval or as soon as the buffer holds batchSize rows. Rows from a
+// failed flush are kept and retried on the next flush. It is safe for concurrent use.
+type BatchWriter struct {
+	db        *sql.DB
+	table     string
+	columns   []string
+	batchSize int
+
+	// afterFlush, when set, runs after each successful flush with the rows written.
+	afterFlush func(ctx context.Context, rows [][]interface{}) error
+
+	mu      sync.Mutex
+	pending [][]interface{}
+	full    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// maxBufferedBatches bounds how many batches' worth of rows are kept while the database
+// is failing. Beyond that the oldest rows are dropped and the drop is logged.
+const maxBufferedBatches = 10
+
+// flushTimeout bounds each flush, so a hung database cannot stall the writer or shutdown.
+const flushTimeout = 10 * time.Second
+
+// NewBatchWriter starts a writer that flushes rows into table every interval.
+func NewBatchWriter(db *sql.DB, table string, columns []string, batchSize int, interval time.Duration) *BatchWriter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	b := &BatchWriter{
+		db:        db,
+		table:     table,
+		columns:   columns,
+		batchSize: batchSize,
+		full:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go b.run(interval)
+	return b
+}
+
+// Add queues one row. values must match the writer's columns.
+func (b *BatchWriter) Add(values ...interface{}) {
+	b.mu.Lock()
+	b.pending = append(b.pending, values)
+	n := len(b.pending)
+	b.mu.Unlock()
+
+	if n >= b.batchSize {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close stops the background flushing and writes out everything still buffered.
+func (b *BatchWriter) Close() {
+	close(b.done)
+	<-b.stopped
+	b.Flush()
+}
+
+func (b *BatchWriter) run(interval time.Duration) {
+	defer close(b.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.Flush()
+		case <-b.full:
+			b.Flush()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Flush writes the buffered rows now, in batches of at most batchSize rows.
+func (b *BatchWriter) Flush() {
+	b.mu.Lock()
+	rows := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	for len(rows) > 0 {
+		n := min(len(rows), b.batchSize)
+		if err := b.insert(ctx, rows[:n]); err != nil {
+			slog.Error("batch flush failed, will retry", "table", b.table, "rows", len(rows), "error", err)
+			b.requeue(rows)
+			return
+		}
+		rows = rows[n:]
+	}
+}
+
+// requeue puts rows from a failed flush back in front of anything added since.
+func (b *BatchWriter) requeue(rows [][]interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = append(rows, b.pending...)
+	if limit := b.batchSize * maxBufferedBatches; len(b.pending) > limit {
+		dropped := len(b.pending) - limit
+		b.pending = b.pending[dropped:]
+		slog.Error("dropped buffered rows after repeated flush failures", "table", b.table, "rows", dropped)
+	}
+}
+
+func (b *BatchWriter) insert(ctx context.Context, rows [][]interface{}) error {
+	quoted := make([]string, len(b.columns))
+	for i, column := range b.columns {
+		quoted[i] = `"` + column + `"`
+	}
+
+	var query strings.Builder
+	fmt.Fprintf(&query, `INSERT INTO "%s" (%s) VALUES `, b.table, strings.Join(quoted, ", "))
+
+	args := make([]interface{}, 0, len(rows)*len(b.columns))
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("(")
+		for j := range row {
+			if j > 0 {
+				query.WriteString(", ")
+			}
+			args = append(args, row[j])
+			fmt.Fprintf(&query, "$%d", len(args))
+		}
+		query.WriteString(")")
+	}
+
+	if _, err := b.db.ExecContext(ctx, query.String(), args...); err != nil {
+		return err
+	}
+
+	if b.afterFlush != nil {
+		if err := b.afterFlush(ctx, rows); err != nil {
+			slog.Error("post-flush step failed", "table", b.table, "error", err)
+		}
+	}
+
+	return nil
+}
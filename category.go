@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// titleCaseCategories makes normalizeCategory upper-case the first letter of every word.
+// It is set from the CATEGORY_TITLE_CASE setting at startup.
+var titleCaseCategories bool
+
+// normalizeCategory cleans up a category name received from a client:
+//
+//   - leading and trailing whitespace is removed
+//   - runs of internal whitespace are collapsed to a single space
+//   - when titleCaseCategories is set, the first letter of every word is upper-cased
+//     and the rest of the word is left as is, so "TV & video" becomes "TV & Video"
+//
+// A name that is empty after trimming normalizes to "". Lookups compare normalized names
+// case-insensitively, so "  electronics " and "Electronics" find the same category.
+func normalizeCategory(name string) string {
+	words := strings.Fields(name)
+	if titleCaseCategories {
+		for i, word := range words {
+			first, size := utf8.DecodeRuneInString(word)
+			words[i] = string(unicode.ToUpper(first)) + word[size:]
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// maxCategoriesPerRequest caps how many categories one listing of several categories may ask
+// for; more are rejected with ErrTooManyCategories.
+const maxCategoriesPerRequest = 20
+
+// normalizeCategories normalizes each name, dropping empty names and duplicates.
+func normalizeCategories(names []string) []string {
+	categories := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if category := normalizeCategory(name); category != "" && !seen[strings.ToLower(category)] {
+			seen[strings.ToLower(category)] = true
+			categories = append(categories, category)
+		}
+	}
+	return categories
+}
+
+// categoryExists reports whether the category is in the Categories table or has products,
+// comparing names case-insensitively like the category lookups do.
+func categoryExists(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM "Categories" WHERE lower("name") = lower($1))
+			OR EXISTS (SELECT 1 FROM "Products" WHERE lower("categoryName") = lower($1))`, name).Scan(&exists)
+	return exists, err
+}
+
+// CategoryStats are aggregates over the products of a category. Averages are 0 for a
+// category without products.
+type CategoryStats struct {
+	Category        string  `json:"category"`
+	ProductCount    int     `json:"productCount"`
+	AveragePrice    float64 `json:"averagePrice"`
+	AverageStars    float64 `json:"averageStars"`
+	TotalReviews    int64   `json:"totalReviews"`
+	BestSellerCount int     `json:"bestSellerCount"`
+	UnitsInStock    int64   `json:"unitsInStock"`
+}
+
+// getCategoryStats computes the CategoryStats of a category in one query. It returns
+// ErrCategoryNotFound for a category that is neither in the Categories table nor has products.
+func getCategoryStats(ctx context.Context, db *sql.DB, category string) (*CategoryStats, error) {
+	stats := &CategoryStats{Category: category}
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*),
+			COALESCE(AVG(p."price"), 0),
+			COALESCE(AVG(p."stars"), 0),
+			COALESCE(SUM(p."reviews"), 0),
+			COUNT(*) FILTER (WHERE p."isBestSeller"),
+			COALESCE(SUM(pc."count"), 0)
+		FROM "Products" p
+		LEFT JOIN "ProductCounts" pc ON pc."asin" = p."asin"
+		WHERE lower(p."categoryName") = lower($1)`, category).Scan(
+		&stats.ProductCount, &stats.AveragePrice, &stats.AverageStars, &stats.TotalReviews, &stats.BestSellerCount, &stats.UnitsInStock)
+	if err != nil {
+		return nil, err
+	}
+
+	if stats.ProductCount == 0 {
+		exists, err := categoryExists(ctx, db, category)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrCategoryNotFound
+		}
+	}
+
+	return stats, nil
+}
+
+// CategoryNode is a category in the category tree.
+type CategoryNode struct {
+	Name string `json:"name"`
+	// ProductCount counts the products directly in this category.
+	ProductCount int `json:"productCount"`
+	// TotalProductCount also includes the products of all descendant categories.
+	TotalProductCount int            `json:"totalProductCount"`
+	Children          []CategoryNode `json:"children"`
+}
+
+// categoryNames selects every category, from the Categories table and from the products
+// themselves, once per lower-cased "key": names differing only in case are one category. Its
+// "name" is the one in the Categories table, or else the alphabetically first spelling the
+// products use.
+const categoryNames = `
+	SELECT lower(n."name") AS "key", COALESCE(MIN(c."name"), MIN(n."name")) AS "name"
+	FROM (SELECT "name" FROM "Categories" UNION SELECT "categoryName" FROM "Products") n
+	LEFT JOIN "Categories" c ON c."name" = n."name"
+	GROUP BY lower(n."name")`
+
+// categoryCounts selects the number of products per lower-cased category "key".
+const categoryCounts = `
+	SELECT lower("categoryName") AS "key", COUNT(*) AS "count" FROM "Products" GROUP BY lower("categoryName")`
+
+// getCategoryTree retrieves every category, from the Categories table and from the products
+// themselves, arranged under their parent categories.
+func getCategoryTree(ctx context.Context, db *sql.DB) ([]CategoryNode, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT n."name", COALESCE(parent."name", c."parentCategory"), COALESCE(p."count", 0)
+		FROM (`+categoryNames+`) n
+		LEFT JOIN "Categories" c ON lower(c."name") = n."key"
+		LEFT JOIN (`+categoryNames+`) parent ON parent."key" = lower(c."parentCategory")
+		LEFT JOIN (`+categoryCounts+`) p ON p."key" = n."key"`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parents := make(map[string]string)
+	counts := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var parent sql.NullString
+		var count int
+		if err := rows.Scan(&name, &parent, &count); err != nil {
+			return nil, err
+		}
+		parents[name] = parent.String
+		counts[name] = count
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return buildCategoryTree(parents, counts), nil
+}
+
+// buildCategoryTree arranges categories into a forest. parents maps every category to its
+// parent, "" for top-level categories. A category whose parent is unknown becomes a root.
+// Categories caught in a parent cycle can't be reached from any root; each cycle is broken
+// by promoting its alphabetically first member to a root. Siblings are sorted by name.
+func buildCategoryTree(parents map[string]string, counts map[string]int) []CategoryNode {
+	names := make([]string, 0, len(parents))
+	for name := range parents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	children := make(map[string][]string)
+	var roots []string
+	for _, name := range names {
+		parent := parents[name]
+		if _, known := parents[parent]; parent == "" || parent == name || !known {
+			roots = append(roots, name)
+			continue
+		}
+		children[parent] = append(children[parent], name)
+	}
+
+	visited := make(map[string]bool)
+	var build func(name string) CategoryNode
+	build = func(name string) CategoryNode {
+		visited[name] = true
+		node := CategoryNode{Name: name, ProductCount: counts[name], Children: make([]CategoryNode, 0)}
+		node.TotalProductCount = node.ProductCount
+		for _, child := range children[name] {
+			if visited[child] {
+				continue
+			}
+			childNode := build(child)
+			node.TotalProductCount += childNode.TotalProductCount
+			node.Children = append(node.Children, childNode)
+		}
+		return node
+	}
+
+	tree := make([]CategoryNode, 0, len(roots))
+	for _, root := range roots {
+		tree = append(tree, build(root))
+	}
+
+	for _, name := range names {
+		if !visited[name] {
+			slog.Warn("category is part of a parent cycle, listing it as a top-level category", "category", name)
+			tree = append(tree, build(name))
+		}
+	}
+
+	return tree
+}
+
+// createCategory adds a category to the Categories table, so it exists before any product is
+// stocked in it. It returns ErrCategoryExists when the category already has a row, whatever
+// its case.
+func createCategory(ctx context.Context, db *sql.DB, name, parent string) error {
+	var parentCategory sql.NullString
+	if parent != "" {
+		parentCategory = sql.NullString{String: parent, Valid: true}
+	}
+
+	result, err := db.ExecContext(ctx, "INSERT INTO \"Categories\" (\"name\", \"parentCategory\") VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		name, parentCategory)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrCategoryExists
+	}
+	return nil
+}
+
+// deleteCategory removes a category from the Categories table and makes its subcategories
+// top-level, comparing names regardless of case. It returns ErrCategoryNotFound when the
+// category has no row and ErrCategoryNotEmpty while products are still in it, since the
+// category would otherwise keep being listed.
+func deleteCategory(ctx context.Context, db *sql.DB, name string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM \"Categories\" WHERE lower(\"name\") = lower($1)", name)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrCategoryNotFound
+	}
+
+	var hasProducts bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM \"Products\" WHERE lower(\"categoryName\") = lower($1))", name).Scan(&hasProducts)
+	if err != nil {
+		return err
+	}
+	if hasProducts {
+		return ErrCategoryNotEmpty
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE \"Categories\" SET \"parentCategory\" = NULL WHERE lower(\"parentCategory\") = lower($1)", name)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CategoryCache serves the category list from memory for ttl before reading it from the
+// database again. Only one request refreshes an expired list; concurrent requests wait for
+// it instead of all querying the database.
+type CategoryCache struct {
+	db        *sql.DB
+	ttl       time.Duration
+	collation string
+
+	mu         sync.Mutex
+	generation int
+	entries    map[bool]*categoryCacheEntry
+}
+
+// categoryCacheEntry is the cached list for one sort order.
+type categoryCacheEntry struct {
+	categories []Category
+	expires    time.Time
+	// refreshing is closed when the request refreshing the entry is done.
+	refreshing chan struct{}
+}
+
+// NewCategoryCache caches the results of getCategories for ttl. A ttl of 0 disables caching.
+func NewCategoryCache(db *sql.DB, ttl time.Duration, collation string) *CategoryCache {
+	return &CategoryCache{db: db, ttl: ttl, collation: collation, entries: make(map[bool]*categoryCacheEntry)}
+}
+
+// Get returns the categories sorted by name, from the cache when it hasn't expired.
+func (c *CategoryCache) Get(ctx context.Context, descending bool) ([]Category, error) {
+	if c.ttl <= 0 {
+		return c.load(ctx, descending)
+	}
+
+	for {
+		c.mu.Lock()
+		entry, ok := c.entries[descending]
+		if !ok {
+			entry = &categoryCacheEntry{}
+			c.entries[descending] = entry
+		}
+		if entry.categories != nil && time.Now().Before(entry.expires) {
+			c.mu.Unlock()
+			return entry.categories, nil
+		}
+		if wait := entry.refreshing; wait != nil {
+			c.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		done := make(chan struct{})
+		entry.refreshing = done
+		generation := c.generation
+		c.mu.Unlock()
+
+		categories, err := c.load(ctx, descending)
+
+		c.mu.Lock()
+		entry.refreshing = nil
+		if err == nil && generation == c.generation {
+			entry.categories = categories
+			entry.expires = time.Now().Add(c.ttl)
+		}
+		c.mu.Unlock()
+		close(done)
+
+		return categories, err
+	}
+}
+
+// Invalidate drops the cached lists, so the next request reads the categories again. Call it
+// after changing the categories.
+func (c *CategoryCache) Invalidate() {
+	c.mu.Lock()
+	c.generation++
+	c.entries = make(map[bool]*categoryCacheEntry)
+	c.mu.Unlock()
+}
+
+// load reads the categories from the database, retrying transient errors.
+func (c *CategoryCache) load(ctx context.Context, descending bool) ([]Category, error) {
+	var categories []Category
+	err := readRetry.Do(ctx, func() (err error) {
+		categories, err = getCategories(ctx, c.db, descending, c.collation)
+		return err
+	})
+	return categories, err
+}
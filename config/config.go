@@ -0,0 +1,345 @@
+// Package config loads the service's settings. They are read from the JSON or YAML file named
+// by CONFIG_FILE, if any, and then from environment variables of the same name, which take
+// precedence, e.g. {"PORT": 9000, "READ_TIMEOUT": "10s"}, "PORT: 9000" or PORT=9000.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the service. The JSON and YAML keys are the names of the
+// environment variables.
+type Config struct {
+	// ListenAddr is the address to listen on. It defaults to ":" followed by Port.
+	ListenAddr string `json:"LISTEN_ADDR" yaml:"LISTEN_ADDR"`
+	Port       int    `json:"PORT" yaml:"PORT"`
+	// TLSCertFile and TLSKeyFile serve HTTPS when both are set.
+	TLSCertFile string `json:"TLS_CERT_FILE" yaml:"TLS_CERT_FILE"`
+	TLSKeyFile  string `json:"TLS_KEY_FILE" yaml:"TLS_KEY_FILE"`
+
+	DatabaseURL       string   `json:"DATABASE_URL" yaml:"DATABASE_URL"`
+	DBMaxOpenConns    int      `json:"DB_MAX_OPEN_CONNS" yaml:"DB_MAX_OPEN_CONNS"`
+	DBMaxIdleConns    int      `json:"DB_MAX_IDLE_CONNS" yaml:"DB_MAX_IDLE_CONNS"`
+	DBConnMaxLifetime Duration `json:"DB_CONN_MAX_LIFETIME" yaml:"DB_CONN_MAX_LIFETIME"`
+	QueryTimeout      Duration `json:"QUERY_TIMEOUT" yaml:"QUERY_TIMEOUT"`
+	// DBRetryMaxAttempts and DBRetryBaseDelay control how reads are retried after transient
+	// database errors.
+	DBRetryMaxAttempts int      `json:"DB_RETRY_MAX_ATTEMPTS" yaml:"DB_RETRY_MAX_ATTEMPTS"`
+	DBRetryBaseDelay   Duration `json:"DB_RETRY_BASE_DELAY" yaml:"DB_RETRY_BASE_DELAY"`
+	// RunMigrations applies the embedded migrations at startup.
+	RunMigrations bool `json:"RUN_MIGRATIONS" yaml:"RUN_MIGRATIONS"`
+
+	ReadTimeout     Duration `json:"READ_TIMEOUT" yaml:"READ_TIMEOUT"`
+	WriteTimeout    Duration `json:"WRITE_TIMEOUT" yaml:"WRITE_TIMEOUT"`
+	IdleTimeout     Duration `json:"IDLE_TIMEOUT" yaml:"IDLE_TIMEOUT"`
+	ShutdownTimeout Duration `json:"SHUTDOWN_TIMEOUT" yaml:"SHUTDOWN_TIMEOUT"`
+
+	LogLevel string `json:"LOG_LEVEL" yaml:"LOG_LEVEL"`
+
+	// RateLimitRPS is the requests per second each client IP may make, 0 to turn the limit off.
+	RateLimitRPS   float64 `json:"RATE_LIMIT_RPS" yaml:"RATE_LIMIT_RPS"`
+	RateLimitBurst int     `json:"RATE_LIMIT_BURST" yaml:"RATE_LIMIT_BURST"`
+	// TrustProxy takes the client IP from X-Forwarded-For, behind a reverse proxy.
+	TrustProxy bool `json:"TRUST_PROXY" yaml:"TRUST_PROXY"`
+	// AllowedOrigins is a comma-separated list of origins allowed by CORS, or "*".
+	AllowedOrigins string `json:"ALLOWED_ORIGINS" yaml:"ALLOWED_ORIGINS"`
+
+	// APIKey guards the admin routes and every write. Without it admin routes are closed and
+	// writes are open.
+	APIKey string `json:"API_KEY" yaml:"API_KEY"`
+	// JWTSecret signs login tokens; without it a random secret is used.
+	JWTSecret string   `json:"JWT_SECRET" yaml:"JWT_SECRET"`
+	JWTTTL    Duration `json:"JWT_TTL" yaml:"JWT_TTL"`
+	// ReadOnly rejects every mutating request, e.g. during database maintenance.
+	ReadOnly bool `json:"READ_ONLY" yaml:"READ_ONLY"`
+
+	ViewBatchSize      int      `json:"VIEW_BATCH_SIZE" yaml:"VIEW_BATCH_SIZE"`
+	ViewFlushInterval  Duration `json:"VIEW_FLUSH_INTERVAL" yaml:"VIEW_FLUSH_INTERVAL"`
+	CategoryTitleCase  bool     `json:"CATEGORY_TITLE_CASE" yaml:"CATEGORY_TITLE_CASE"`
+	CategoryCollation  string   `json:"CATEGORY_COLLATION" yaml:"CATEGORY_COLLATION"`
+	CategoriesCacheTTL Duration `json:"CATEGORIES_CACHE_TTL" yaml:"CATEGORIES_CACHE_TTL"`
+	MaxFilters         int      `json:"MAX_FILTERS" yaml:"MAX_FILTERS"`
+	// PriceCurrency is the ISO 4217 code prices are stored in, and ExchangeRates the
+	// CODE=rate pairs prices can be converted with; the service parses both.
+	PriceCurrency      string   `json:"PRICE_CURRENCY" yaml:"PRICE_CURRENCY"`
+	ExchangeRates      string   `json:"EXCHANGE_RATES" yaml:"EXCHANGE_RATES"`
+	CancellationWindow Duration `json:"CANCELLATION_WINDOW" yaml:"CANCELLATION_WINDOW"`
+	IdempotencyKeyTTL  Duration `json:"IDEMPOTENCY_KEY_TTL" yaml:"IDEMPOTENCY_KEY_TTL"`
+	LowStockThreshold  int      `json:"LOW_STOCK_THRESHOLD" yaml:"LOW_STOCK_THRESHOLD"`
+}
+
+// Duration is a time.Duration written as a string such as "5s" in the config file.
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\": %w", err)
+	}
+	return d.parse(s)
+}
+
+// UnmarshalYAML parses a duration string.
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: duration must be a string such as \"5s\"", value.Line)
+	}
+	return d.parse(value.Value)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Default returns the settings used when neither the file nor the environment sets them.
+func Default() Config {
+	return Config{
+		Port:               8080,
+		DBMaxOpenConns:     25,
+		DBMaxIdleConns:     5,
+		DBConnMaxLifetime:  Duration(5 * time.Minute),
+		QueryTimeout:       Duration(5 * time.Second),
+		DBRetryMaxAttempts: 3,
+		DBRetryBaseDelay:   Duration(50 * time.Millisecond),
+		ReadTimeout:        Duration(15 * time.Second),
+		WriteTimeout:       Duration(30 * time.Second),
+		IdleTimeout:        Duration(2 * time.Minute),
+		ShutdownTimeout:    Duration(15 * time.Second),
+		LogLevel:           "info",
+		RateLimitRPS:       10,
+		RateLimitBurst:     20,
+		JWTTTL:             Duration(24 * time.Hour),
+		ViewBatchSize:      100,
+		ViewFlushInterval:  Duration(2 * time.Second),
+		CategoriesCacheTTL: Duration(time.Minute),
+		MaxFilters:         8,
+		CancellationWindow: Duration(24 * time.Hour),
+		IdempotencyKeyTTL:  Duration(24 * time.Hour),
+		LowStockThreshold:  5,
+	}
+}
+
+// Load reads the configuration and validates it. Malformed and out-of-range values are
+// rejected rather than replaced by the defaults, and every problem is reported at once.
+func Load() (Config, error) {
+	cfg := Default()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(data, &cfg)
+		default:
+			err = json.Unmarshal(data, &cfg)
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	var errs []error
+	envString := func(name string, dst *string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	envInt := func(name string, dst *int) {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", name, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	envFloat := func(name string, dst *float64) {
+		if v := os.Getenv(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", name, v))
+				return
+			}
+			*dst = f
+		}
+	}
+	envBool := func(name string, dst *bool) {
+		if v := os.Getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not true or false", name, v))
+				return
+			}
+			*dst = b
+		}
+	}
+	envDuration := func(name string, dst *Duration) {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a duration", name, v))
+				return
+			}
+			*dst = Duration(d)
+		}
+	}
+
+	envString("LISTEN_ADDR", &cfg.ListenAddr)
+	envInt("PORT", &cfg.Port)
+	envString("TLS_CERT_FILE", &cfg.TLSCertFile)
+	envString("TLS_KEY_FILE", &cfg.TLSKeyFile)
+	envString("DATABASE_URL", &cfg.DatabaseURL)
+	envInt("DB_MAX_OPEN_CONNS", &cfg.DBMaxOpenConns)
+	envInt("DB_MAX_IDLE_CONNS", &cfg.DBMaxIdleConns)
+	envDuration("DB_CONN_MAX_LIFETIME", &cfg.DBConnMaxLifetime)
+	envDuration("QUERY_TIMEOUT", &cfg.QueryTimeout)
+	envInt("DB_RETRY_MAX_ATTEMPTS", &cfg.DBRetryMaxAttempts)
+	envDuration("DB_RETRY_BASE_DELAY", &cfg.DBRetryBaseDelay)
+	envBool("RUN_MIGRATIONS", &cfg.RunMigrations)
+	envDuration("READ_TIMEOUT", &cfg.ReadTimeout)
+	envDuration("WRITE_TIMEOUT", &cfg.WriteTimeout)
+	envDuration("IDLE_TIMEOUT", &cfg.IdleTimeout)
+	envDuration("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout)
+	envString("LOG_LEVEL", &cfg.LogLevel)
+	envFloat("RATE_LIMIT_RPS", &cfg.RateLimitRPS)
+	envInt("RATE_LIMIT_BURST", &cfg.RateLimitBurst)
+	envBool("TRUST_PROXY", &cfg.TrustProxy)
+	envString("ALLOWED_ORIGINS", &cfg.AllowedOrigins)
+	envString("API_KEY", &cfg.APIKey)
+	envString("JWT_SECRET", &cfg.JWTSecret)
+	envDuration("JWT_TTL", &cfg.JWTTTL)
+	envBool("READ_ONLY", &cfg.ReadOnly)
+	envInt("VIEW_BATCH_SIZE", &cfg.ViewBatchSize)
+	envDuration("VIEW_FLUSH_INTERVAL", &cfg.ViewFlushInterval)
+	envBool("CATEGORY_TITLE_CASE", &cfg.CategoryTitleCase)
+	envString("CATEGORY_COLLATION", &cfg.CategoryCollation)
+	envDuration("CATEGORIES_CACHE_TTL", &cfg.CategoriesCacheTTL)
+	envInt("MAX_FILTERS", &cfg.MaxFilters)
+	envString("PRICE_CURRENCY", &cfg.PriceCurrency)
+	envString("EXCHANGE_RATES", &cfg.ExchangeRates)
+	envDuration("CANCELLATION_WINDOW", &cfg.CancellationWindow)
+	envDuration("IDEMPOTENCY_KEY_TTL", &cfg.IdempotencyKeyTTL)
+	envInt("LOW_STOCK_THRESHOLD", &cfg.LowStockThreshold)
+
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = ":" + strconv.Itoa(cfg.Port)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return cfg, errors.Join(errs...)
+}
+
+// Validate reports every setting that is out of range.
+func (c Config) Validate() error {
+	var errs []error
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("PORT: %d is not between 1 and 65535", c.Port))
+	}
+	if err := validateListenAddr(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("LISTEN_ADDR: %w", err))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+	if c.DatabaseURL == "" {
+		errs = append(errs, errors.New("DATABASE_URL is required"))
+	}
+	if c.DBMaxOpenConns < 1 {
+		errs = append(errs, fmt.Errorf("DB_MAX_OPEN_CONNS: %d is less than 1", c.DBMaxOpenConns))
+	}
+	if c.DBMaxIdleConns < 0 || c.DBMaxIdleConns > c.DBMaxOpenConns {
+		errs = append(errs, fmt.Errorf("DB_MAX_IDLE_CONNS: %d is not between 0 and DB_MAX_OPEN_CONNS", c.DBMaxIdleConns))
+	}
+	for _, n := range []struct {
+		name  string
+		value int
+		min   int
+	}{
+		{"DB_RETRY_MAX_ATTEMPTS", c.DBRetryMaxAttempts, 1},
+		{"VIEW_BATCH_SIZE", c.ViewBatchSize, 1},
+		{"MAX_FILTERS", c.MaxFilters, 0},
+		{"LOW_STOCK_THRESHOLD", c.LowStockThreshold, 0},
+	} {
+		if n.value < n.min {
+			errs = append(errs, fmt.Errorf("%s: %d is less than %d", n.name, n.value, n.min))
+		}
+	}
+	for _, d := range []struct {
+		name  string
+		value Duration
+	}{
+		{"DB_CONN_MAX_LIFETIME", c.DBConnMaxLifetime},
+		{"QUERY_TIMEOUT", c.QueryTimeout},
+		{"READ_TIMEOUT", c.ReadTimeout},
+		{"WRITE_TIMEOUT", c.WriteTimeout},
+		{"IDLE_TIMEOUT", c.IdleTimeout},
+		{"SHUTDOWN_TIMEOUT", c.ShutdownTimeout},
+		{"JWT_TTL", c.JWTTTL},
+		{"VIEW_FLUSH_INTERVAL", c.ViewFlushInterval},
+		{"IDEMPOTENCY_KEY_TTL", c.IdempotencyKeyTTL},
+	} {
+		if d.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", d.name))
+		}
+	}
+	// These may be 0: no delay between retries, no category caching, no cancellations
+	for _, d := range []struct {
+		name  string
+		value Duration
+	}{
+		{"DB_RETRY_BASE_DELAY", c.DBRetryBaseDelay},
+		{"CATEGORIES_CACHE_TTL", c.CategoriesCacheTTL},
+		{"CANCELLATION_WINDOW", c.CancellationWindow},
+	} {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", d.name))
+		}
+	}
+	if c.RateLimitRPS < 0 || math.IsNaN(c.RateLimitRPS) || math.IsInf(c.RateLimitRPS, 0) {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_RPS: %v is not 0 or a positive number", c.RateLimitRPS))
+	}
+	if c.RateLimitBurst < 0 || (c.RateLimitRPS > 0 && c.RateLimitBurst < 1) {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_BURST: %d is less than 1", c.RateLimitBurst))
+	}
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("LOG_LEVEL: %q is not debug, info, warn or error", c.LogLevel))
+	}
+	return errors.Join(errs...)
+}
+
+// validateListenAddr checks that addr is a host:port pair with a numeric port, where the host
+// may be empty to listen on every interface.
+func validateListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("port %q is not a number between 0 and 65535", port)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidateRateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		rps     float64
+		burst   int
+		wantErr bool
+	}{
+		{"defaults", 10, 20, false},
+		{"limit off", 0, 0, false},
+		{"negative burst with the limit off", 0, -1, true},
+		{"negative rate", -1, 20, true},
+		{"zero burst", 10, 0, true},
+		{"negative burst", 10, -5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.DatabaseURL = "postgres://localhost/test"
+			cfg.ListenAddr = ":8080"
+			cfg.RateLimitRPS, cfg.RateLimitBurst = tt.rps, tt.burst
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		wantErr bool
+		check   func(t *testing.T, cfg Config)
+	}{
+		{
+			name: "environment only",
+			env:  map[string]string{"DATABASE_URL": "postgres://env", "PORT": "9000", "READ_ONLY": "true"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.ListenAddr != ":9000" || !cfg.ReadOnly || cfg.MaxFilters != 8 {
+					t.Errorf("got LISTEN_ADDR %q, READ_ONLY %v, MAX_FILTERS %d", cfg.ListenAddr, cfg.ReadOnly, cfg.MaxFilters)
+				}
+			},
+		},
+		{
+			name: "JSON file",
+			file: write("config.json", `{"DATABASE_URL": "postgres://file", "READ_TIMEOUT": "10s", "RATE_LIMIT_BURST": 5}`),
+			check: func(t *testing.T, cfg Config) {
+				if cfg.DatabaseURL != "postgres://file" || time.Duration(cfg.ReadTimeout) != 10*time.Second || cfg.RateLimitBurst != 5 {
+					t.Errorf("got %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "YAML file with the environment winning",
+			file: write("config.yaml", "DATABASE_URL: postgres://file\nJWT_TTL: 1h\nTRUST_PROXY: true\nPORT: 9000\n"),
+			env:  map[string]string{"PORT": "9001"},
+			check: func(t *testing.T, cfg Config) {
+				if time.Duration(cfg.JWTTTL) != time.Hour || !cfg.TrustProxy || cfg.Port != 9001 {
+					t.Errorf("got JWT_TTL %v, TRUST_PROXY %v, PORT %d", time.Duration(cfg.JWTTTL), cfg.TrustProxy, cfg.Port)
+				}
+			},
+		},
+		{
+			name:    "malformed variable",
+			env:     map[string]string{"DATABASE_URL": "postgres://env", "VIEW_BATCH_SIZE": "many"},
+			wantErr: true,
+		},
+		{
+			name:    "TLS certificate without a key",
+			env:     map[string]string{"DATABASE_URL": "postgres://env", "TLS_CERT_FILE": "cert.pem"},
+			wantErr: true,
+		},
+		{
+			name:    "missing database",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"CONFIG_FILE", "DATABASE_URL", "PORT", "LISTEN_ADDR"} {
+				t.Setenv(name, "")
+			}
+			if tt.file != "" {
+				t.Setenv("CONFIG_FILE", tt.file)
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			cfg, err := Load()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, cfg)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dbQueryDuration is registered by NewPrometheusMetrics. Queries are timed until their first
+// row arrives, not until the rows have been read.
+var dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "db_query_duration_seconds",
+	Help:    "Database query duration by operation (query, exec, begin, commit or rollback).",
+	Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+}, []string{"operation"})
+
+// instrumentedConnector wraps a driver.Connector so that every connection it opens records
+// its queries in dbQueryDuration.
+type instrumentedConnector struct {
+	driver.Connector
+}
+
+func (c instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedConn{conn}, nil
+}
+
+// observeQuery records how long operation took, unless the driver skipped it and database/sql
+// falls back to another method that records it instead.
+func observeQuery(operation string, start time.Time, err error) {
+	if err != driver.ErrSkip {
+		dbQueryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	}
+}
+
+// instrumentedConn passes every call through to the driver's connection, timing queries,
+// execs and transactions. Optional interfaces the driver does not implement are reported as
+// such, so database/sql keeps its usual fallbacks.
+type instrumentedConn struct {
+	driver.Conn
+}
+
+func (c instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	observeQuery("query", start, err)
+	return rows, err
+}
+
+func (c instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	observeQuery("exec", start, err)
+	return result, err
+}
+
+func (c instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	start := time.Now()
+	var tx driver.Tx
+	var err error
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	observeQuery("begin", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedTx{tx}, nil
+}
+
+func (c instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c instrumentedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c instrumentedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+type instrumentedTx struct {
+	driver.Tx
+}
+
+func (t instrumentedTx) Commit() error {
+	start := time.Now()
+	err := t.Tx.Commit()
+	observeQuery("commit", start, err)
+	return err
+}
+
+func (t instrumentedTx) Rollback() error {
+	start := time.Now()
+	err := t.Tx.Rollback()
+	observeQuery("rollback", start, err)
+	return err
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Errors reported to clients. Each one has a problem type URI in problemTypes.
+var (
+	ErrInvalidPayload           = errors.New("Invalid request payload")
+	ErrInvalidLimit             = errors.New("Invalid limit")
+	ErrInvalidOffset            = errors.New("Invalid offset")
+	ErrInvalidRank              = errors.New("Invalid rank")
+	ErrInvalidSize              = errors.New("Invalid size")
+	ErrInvalidSort              = errors.New("Invalid sort")
+	ErrInvalidThreshold         = errors.New("Invalid threshold")
+	ErrMissingQuery             = errors.New("Missing search query")
+	ErrMissingCategory          = errors.New("Missing category")
+	ErrMissingASINs             = errors.New("Missing asins")
+	ErrUnauthorized             = errors.New("Unauthorized")
+	ErrProductNotFound          = errors.New("product not found")
+	ErrOutOfStock               = errors.New("product out of stock")
+	ErrInvalidIfMatch           = errors.New("Invalid If-Match header")
+	ErrStaleBasket              = errors.New("basket was modified by another request")
+	ErrInvalidFilter            = errors.New("Invalid filter")
+	ErrTooManyFilters           = errors.New("Too many filters")
+	ErrMissingSeed              = errors.New("Missing seed")
+	ErrInvalidFraction          = errors.New("Invalid fraction")
+	ErrInvalidLocale            = errors.New("Invalid locale")
+	ErrMissingItems             = errors.New("Missing items")
+	ErrInvalidQuantity          = errors.New("Invalid quantity")
+	ErrTooManyCategories        = errors.New("Too many categories")
+	ErrInvalidPerCategory       = errors.New("Invalid per_category")
+	ErrOrderNotFound            = errors.New("order not found")
+	ErrNotCheckedOut            = errors.New("order is not checked out")
+	ErrAlreadyCancelled         = errors.New("order is already cancelled")
+	ErrCancellationWindowPassed = errors.New("cancellation window has passed")
+	ErrItemNotInBasket          = errors.New("item not in basket")
+	ErrInvalidPriceRange        = errors.New("Invalid price range")
+	ErrEmptyBasket              = errors.New("basket not found or empty")
+	ErrAlreadyCheckedOut        = errors.New("basket is already checked out")
+	ErrInvalidIdempotencyKey    = errors.New("Invalid Idempotency-Key header")
+	ErrIdempotencyKeyReused     = errors.New("Idempotency-Key was already used for another basket")
+	ErrCategoryExists           = errors.New("category already exists")
+	ErrCategoryNotFound         = errors.New("category not found")
+	ErrCategoryNotEmpty         = errors.New("category still has products")
+	ErrInvalidParentCategory    = errors.New("Invalid parent category")
+	ErrInvalidProduct           = errors.New("Invalid product")
+	ErrProductExists            = errors.New("product already exists")
+	ErrInvalidAdjustment        = errors.New("Invalid inventory adjustment")
+	ErrNegativeStock            = errors.New("adjustment would make stock negative")
+	ErrRateLimited              = errors.New("Too many requests")
+	ErrInvalidMinStars          = errors.New("Invalid minStars")
+	ErrNotFound                 = errors.New("not found")
+	ErrMethodNotAllowed         = errors.New("method not allowed")
+	ErrInvalidCursor            = errors.New("Invalid cursor")
+	ErrUnsupportedCurrency      = errors.New("Unsupported currency")
+	ErrMissingUserID            = errors.New("Missing user id")
+	ErrReadOnlyMode             = errors.New("service is in read-only mode")
+	ErrBasketNotFound           = errors.New("basket not found")
+	ErrInvalidOrderID           = errors.New("Invalid order id")
+	ErrInvalidEmail             = errors.New("Invalid email")
+	ErrInvalidPassword          = errors.New("Invalid password")
+	ErrUserExists               = errors.New("user already exists")
+	ErrInvalidCredentials       = errors.New("invalid email or password")
+	ErrMissingToken             = errors.New("bearer token required")
+	ErrInvalidToken             = errors.New("invalid or expired token")
+	ErrForbidden                = errors.New("token does not belong to this user")
+)
+
+// problemTypes maps the client-facing errors to their RFC 7807 problem type URIs.
+var problemTypes = map[error]string{
+	ErrInvalidPayload:           "/problems/invalid-payload",
+	ErrInvalidLimit:             "/problems/invalid-limit",
+	ErrInvalidOffset:            "/problems/invalid-offset",
+	ErrInvalidRank:              "/problems/invalid-rank",
+	ErrInvalidSize:              "/problems/invalid-size",
+	ErrInvalidSort:              "/problems/invalid-sort",
+	ErrInvalidThreshold:         "/problems/invalid-threshold",
+	ErrMissingQuery:             "/problems/missing-query",
+	ErrMissingCategory:          "/problems/missing-category",
+	ErrMissingASINs:             "/problems/missing-asins",
+	ErrUnauthorized:             "/problems/unauthorized",
+	ErrProductNotFound:          "/problems/product-not-found",
+	ErrOutOfStock:               "/problems/out-of-stock",
+	ErrInvalidIfMatch:           "/problems/invalid-if-match",
+	ErrStaleBasket:              "/problems/stale-basket",
+	ErrInvalidFilter:            "/problems/invalid-filter",
+	ErrTooManyFilters:           "/problems/too-many-filters",
+	ErrMissingSeed:              "/problems/missing-seed",
+	ErrInvalidFraction:          "/problems/invalid-fraction",
+	ErrInvalidLocale:            "/problems/invalid-locale",
+	ErrMissingItems:             "/problems/missing-items",
+	ErrInvalidQuantity:          "/problems/invalid-quantity",
+	ErrTooManyCategories:        "/problems/too-many-categories",
+	ErrInvalidPerCategory:       "/problems/invalid-per-category",
+	ErrOrderNotFound:            "/problems/order-not-found",
+	ErrNotCheckedOut:            "/problems/not-checked-out",
+	ErrAlreadyCancelled:         "/problems/already-cancelled",
+	ErrCancellationWindowPassed: "/problems/cancellation-window-passed",
+	ErrItemNotInBasket:          "/problems/item-not-in-basket",
+	ErrInvalidPriceRange:        "/problems/invalid-price-range",
+	ErrEmptyBasket:              "/problems/empty-basket",
+	ErrAlreadyCheckedOut:        "/problems/already-checked-out",
+	ErrInvalidIdempotencyKey:    "/problems/invalid-idempotency-key",
+	ErrIdempotencyKeyReused:     "/problems/idempotency-key-reused",
+	ErrCategoryExists:           "/problems/category-exists",
+	ErrCategoryNotFound:         "/problems/category-not-found",
+	ErrCategoryNotEmpty:         "/problems/category-not-empty",
+	ErrInvalidParentCategory:    "/problems/invalid-parent-category",
+	ErrInvalidProduct:           "/problems/invalid-product",
+	ErrProductExists:            "/problems/product-exists",
+	ErrInvalidAdjustment:        "/problems/invalid-adjustment",
+	ErrNegativeStock:            "/problems/negative-stock",
+	ErrRateLimited:              "/problems/rate-limited",
+	ErrInvalidMinStars:          "/problems/invalid-min-stars",
+	ErrNotFound:                 "/problems/not-found",
+	ErrMethodNotAllowed:         "/problems/method-not-allowed",
+	ErrInvalidCursor:            "/problems/invalid-cursor",
+	ErrUnsupportedCurrency:      "/problems/unsupported-currency",
+	ErrMissingUserID:            "/problems/missing-user-id",
+	ErrReadOnlyMode:             "/problems/read-only-mode",
+	ErrBasketNotFound:           "/problems/basket-not-found",
+	ErrInvalidOrderID:           "/problems/invalid-order-id",
+	ErrInvalidEmail:             "/problems/invalid-email",
+	ErrInvalidPassword:          "/problems/invalid-password",
+	ErrUserExists:               "/problems/user-exists",
+	ErrInvalidCredentials:       "/problems/invalid-credentials",
+	ErrMissingToken:             "/problems/missing-token",
+	ErrInvalidToken:             "/problems/invalid-token",
+	ErrForbidden:                "/problems/forbidden",
+}
+
+// StockError reports that a product does not have enough units for a request.
+// It matches ErrOutOfStock with errors.Is.
+type StockError struct {
+	ASIN      string `json:"asin"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+}
+
+func (e *StockError) Error() string {
+	return ErrOutOfStock.Error()
+}
+
+func (e *StockError) Is(target error) bool {
+	return target == ErrOutOfStock
+}
+
+// writeStockError responds 409 Conflict with the requested and available quantities so
+// the client can offer to add what is left instead.
+func writeStockError(w http.ResponseWriter, r *http.Request, e *StockError) {
+	writeErrorDetails(w, r, http.StatusConflict, e, e)
+}
+
+// BundleError reports every item of a bundle that could not be reserved.
+// It matches ErrOutOfStock with errors.Is.
+type BundleError struct {
+	Shortages []StockError `json:"shortages"`
+	Missing   []string     `json:"missing"`
+}
+
+func (e *BundleError) Error() string {
+	return "bundle could not be reserved"
+}
+
+func (e *BundleError) Is(target error) bool {
+	return target == ErrOutOfStock
+}
+
+// writeBundleError responds 409 Conflict listing the short and missing bundle items.
+func writeBundleError(w http.ResponseWriter, r *http.Request, e *BundleError) {
+	writeErrorDetails(w, r, http.StatusConflict, e, e)
+}
+
+// ValidationError reports the fields of a request body that failed validation, keyed by
+// their JSON name. It matches ErrInvalidProduct with errors.Is.
+type ValidationError struct {
+	Fields map[string]string `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	return ErrInvalidProduct.Error()
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidProduct
+}
+
+// writeValidationError responds 400 Bad Request with a message for every invalid field.
+func writeValidationError(w http.ResponseWriter, r *http.Request, e *ValidationError) {
+	writeErrorDetails(w, r, http.StatusBadRequest, e, e)
+}
+
+// RateLimitError reports that a client has used up its rate limit, with the state of its
+// bucket. It matches ErrRateLimited with errors.Is.
+type RateLimitError struct {
+	Limit     int `json:"limit"`
+	Remaining int `json:"remaining"`
+	Reset     int `json:"reset"`
+}
+
+func (e *RateLimitError) Error() string {
+	return ErrRateLimited.Error()
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// writeRateLimitError responds 429 Too Many Requests with the X-RateLimit-* headers and the
+// same values in the body.
+func writeRateLimitError(w http.ResponseWriter, r *http.Request, e *RateLimitError) {
+	e.setHeaders(w)
+	writeErrorDetails(w, r, http.StatusTooManyRequests, e, e)
+}
+
+// Problem is an RFC 7807 problem details document.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance"`
+}
+
+// writeJSONError writes a {"error": ..., "status": ...} JSON body with the given status.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+	}{message, status})
+}
+
+// writeError writes err to the client with the given status. Clients that accept
+// application/problem+json get a problem details document, everyone else gets the
+// {"error": ..., "status": ...} JSON body. For 5xx statuses the real error is only logged
+// and the client is told "internal server error", so database details never leak, unless
+// err is itself one of the client-facing errors in problemTypes. A 5xx caused by the
+// request's deadline expiring is reported as 503 Service Unavailable.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	writeErrorDetails(w, r, status, err, nil)
+}
+
+// writeErrorDetails is writeError with extra members: the JSON fields of details, when not nil,
+// are added to the error body, or as extension members to the problem details document.
+func writeErrorDetails(w http.ResponseWriter, r *http.Request, status int, err error, details interface{}) {
+	message := err.Error()
+	_, public := problemTypes[err]
+	if status >= 500 && errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		status = http.StatusServiceUnavailable
+		message = "request timed out"
+	} else if status >= 500 && !public {
+		message = "internal server error"
+	}
+	if status >= 500 && !public {
+		slog.ErrorContext(r.Context(), "request failed",
+			"method", r.Method,
+			"route", routeTemplate(r),
+			"path", r.URL.Path,
+			"status", status,
+			"error", err,
+		)
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), "application/problem+json") {
+		if details != nil {
+			writeJSONErrorDetails(w, status, "application/json", details, map[string]interface{}{"error": message, "status": status})
+			return
+		}
+		writeJSONError(w, status, message)
+		return
+	}
+
+	problem := Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   message,
+		Instance: r.URL.Path,
+	}
+	for sentinel, uri := range problemTypes {
+		if errors.Is(err, sentinel) {
+			problem.Type = uri
+			break
+		}
+	}
+
+	if details != nil {
+		writeJSONErrorDetails(w, status, "application/problem+json", details, map[string]interface{}{
+			"type": problem.Type, "title": problem.Title, "status": problem.Status,
+			"detail": problem.Detail, "instance": problem.Instance,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// writeJSONErrorDetails writes body merged with the JSON fields of details, which can't
+// override the members already in body.
+func writeJSONErrorDetails(w http.ResponseWriter, status int, contentType string, details interface{}, body map[string]interface{}) {
+	var fields map[string]json.RawMessage
+	b, _ := json.Marshal(details)
+	json.Unmarshal(b, &fields)
+	merged := make(map[string]interface{}, len(fields)+len(body))
+	for name, value := range fields {
+		merged[name] = value
+	}
+	for name, value := range body {
+		merged[name] = value
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(merged)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// whereBuilder assembles a parameterized WHERE clause. Conditions are joined with AND and
+// each ? in a condition is replaced by the next $n placeholder.
+type whereBuilder struct {
+	conds []string
+	args  []interface{}
+}
+
+// add appends a condition, binding one argument for each ? in cond.
+func (b *whereBuilder) add(cond string, args ...interface{}) {
+	var sb strings.Builder
+	for _, arg := range args {
+		i := strings.IndexByte(cond, '?')
+		sb.WriteString(cond[:i])
+		sb.WriteString(b.bind(arg))
+		cond = cond[i+1:]
+	}
+	sb.WriteString(cond)
+	b.conds = append(b.conds, sb.String())
+}
+
+// bind adds an argument without a condition and returns its placeholder, for use in
+// LIMIT/OFFSET and similar clauses.
+func (b *whereBuilder) bind(arg interface{}) string {
+	b.args = append(b.args, arg)
+	return "$" + strconv.Itoa(len(b.args))
+}
+
+// clause returns the WHERE clause with a leading space, or "" when there are no conditions.
+func (b *whereBuilder) clause() string {
+	if len(b.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(b.conds, " AND ")
+}
+
+// maxFilters caps how many filters one request may combine, to keep clients from building
+// pathologically complex queries. It is set from the MAX_FILTERS setting; the default of 8
+// leaves room for filters added to ProductFilter later.
+var maxFilters = 8
+
+// ProductFilter holds the optional product filters shared by the listing endpoints.
+type ProductFilter struct {
+	HasImage bool
+	MinPrice *float64
+	MaxPrice *float64
+	MinStars *float64
+}
+
+// active returns the number of filters that will add a condition to the query.
+func (f ProductFilter) active() int {
+	n := 0
+	if f.HasImage {
+		n++
+	}
+	if f.MinPrice != nil {
+		n++
+	}
+	if f.MaxPrice != nil {
+		n++
+	}
+	if f.MinStars != nil {
+		n++
+	}
+	return n
+}
+
+// parseProductFilter reads the product filters from the query string:
+//
+//	has_image=true  only products with a non-empty imgUrl
+//	minPrice=10     only products priced at least 10
+//	maxPrice=50     only products priced at most 50
+//	minStars=4      only products rated at least 4 stars, between 0 and 5
+func parseProductFilter(r *http.Request) (ProductFilter, error) {
+	var filter ProductFilter
+	if v := r.URL.Query().Get("has_image"); v != "" {
+		hasImage, err := strconv.ParseBool(v)
+		if err != nil {
+			return ProductFilter{}, ErrInvalidFilter
+		}
+		filter.HasImage = hasImage
+	}
+	for name, dest := range map[string]**float64{"minPrice": &filter.MinPrice, "maxPrice": &filter.MaxPrice} {
+		if v := r.URL.Query().Get(name); v != "" {
+			price, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(price) || math.IsInf(price, 0) {
+				return ProductFilter{}, ErrInvalidPriceRange
+			}
+			*dest = &price
+		}
+	}
+	if filter.MinPrice != nil && filter.MaxPrice != nil && *filter.MinPrice > *filter.MaxPrice {
+		return ProductFilter{}, ErrInvalidPriceRange
+	}
+	if v := r.URL.Query().Get("minStars"); v != "" {
+		stars, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(stars >= 0 && stars <= 5) {
+			return ProductFilter{}, ErrInvalidMinStars
+		}
+		filter.MinStars = &stars
+	}
+
+	if filter.active() > maxFilters {
+		return ProductFilter{}, ErrTooManyFilters
+	}
+
+	return filter, nil
+}
+
+// apply adds the filter's conditions on the Products table "p" to b.
+func (f ProductFilter) apply(b *whereBuilder) {
+	if f.HasImage {
+		b.add(`p."imgUrl" IS NOT NULL AND p."imgUrl" <> ''`)
+	}
+	if f.MinPrice != nil {
+		b.add(`p."price" >= ?`, *f.MinPrice)
+	}
+	if f.MaxPrice != nil {
+		b.add(`p."price" <= ?`, *f.MaxPrice)
+	}
+	if f.MinStars != nil {
+		b.add(`p."stars" >= ?`, *f.MinStars)
+	}
+}
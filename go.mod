@@ -1,8 +1,26 @@
-module main
+module github.com/mhmmdab09/hacka
 
 go 1.23.0
 
 require (
+    github.com/golang-jwt/jwt/v5 v5.2.2
     github.com/gorilla/mux v1.8.1
     github.com/lib/pq v1.10.9
+    github.com/prometheus/client_golang v1.23.0
+    github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+    golang.org/x/crypto v0.39.0
+    golang.org/x/text v0.28.0
+    golang.org/x/time v0.12.0
+    gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+    github.com/beorn7/perks v1.0.1 // indirect
+    github.com/cespare/xxhash/v2 v2.3.0 // indirect
+    github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+    github.com/prometheus/client_model v0.6.2 // indirect
+    github.com/prometheus/common v0.65.0 // indirect
+    github.com/prometheus/procfs v0.16.1 // indirect
+    golang.org/x/sys v0.33.0 // indirect
+    google.golang.org/protobuf v1.36.6 // indirect
 )
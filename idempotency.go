@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header so keys stay cheap to index.
+const maxIdempotencyKeyLength = 255
+
+// errReplayed is returned by claimIdempotencyKey when the key was already used for a
+// request that has not expired yet.
+var errReplayed = errors.New("idempotency key already used")
+
+// parseIdempotencyKey reads the optional Idempotency-Key header. It returns "" when the
+// header is absent.
+func parseIdempotencyKey(r *http.Request) (string, error) {
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKeyLength {
+		return "", ErrInvalidIdempotencyKey
+	}
+	return key, nil
+}
+
+// claimIdempotencyKey records the user's key for basketID as part of tx. A key older than
+// ttl has expired and is claimed again. If the key is still live, errReplayed is returned;
+// a concurrent request with the same key blocks here until the first one finishes.
+func claimIdempotencyKey(ctx context.Context, tx *sql.Tx, userID, key, basketID string, ttl time.Duration) error {
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO "IdempotencyKeys" ("UserId", "Key", "BasketId")
+		VALUES ($1, $2, $3)
+		ON CONFLICT ("UserId", "Key") DO UPDATE
+		SET "BasketId" = EXCLUDED."BasketId", "Version" = NULL, "CreatedAt" = now()
+		WHERE "IdempotencyKeys"."CreatedAt" < now() - make_interval(secs => $4)`,
+		userID, key, basketID, ttl.Seconds())
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errReplayed
+	}
+	return nil
+}
+
+// completeIdempotencyKey stores the basket version and order produced by the request that
+// claimed the key, so replays can return the same ETag and order.
+func completeIdempotencyKey(ctx context.Context, tx *sql.Tx, userID, key string, version, orderID int64) error {
+	_, err := tx.ExecContext(ctx, "UPDATE \"IdempotencyKeys\" SET \"Version\" = $3, \"OrderId\" = $4 WHERE \"UserId\" = $1 AND \"Key\" = $2",
+		userID, key, version, orderID)
+	return err
+}
+
+// getIdempotentResult returns the checkout recorded for the user's key. Keys recorded before
+// checkouts created orders have an OrderID of 0.
+func getIdempotentResult(ctx context.Context, db *sql.DB, userID, key string) (*CheckoutResult, error) {
+	var result CheckoutResult
+	var version, orderID sql.NullInt64
+	var total sql.NullFloat64
+	err := db.QueryRowContext(ctx, `
+		SELECT k."BasketId", k."Version", k."OrderId", o."Total"
+		FROM "IdempotencyKeys" k
+		LEFT JOIN "Orders" o ON o."OrderId" = k."OrderId"
+		WHERE k."UserId" = $1 AND k."Key" = $2`, userID, key).Scan(&result.BasketID, &version, &orderID, &total)
+	if err != nil {
+		return nil, err
+	}
+	result.Version, result.OrderID, result.Total = version.Int64, orderID.Int64, total.Float64
+	return &result, nil
+}
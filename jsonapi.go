@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const jsonAPIMediaType = "application/vnd.api+json"
+
+// jsonAPIResource is a JSON:API resource object.
+type jsonAPIResource struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Attributes map[string]interface{} `json:"attributes"`
+	Links      map[string]string      `json:"links"`
+}
+
+// jsonAPIDocument is a JSON:API top-level document.
+type jsonAPIDocument struct {
+	Data  interface{}            `json:"data"`
+	Meta  map[string]interface{} `json:"meta,omitempty"`
+	Links map[string]string      `json:"links,omitempty"`
+}
+
+// writeJSON encodes v as the response body. Clients that accept application/vnd.api+json
+// get v wrapped in a JSON:API document when it is one of the product or category types;
+// everyone else gets v as plain JSON. Products get their prices converted when the request
+// asks for another currency with ?currency=EUR, and a formatted price when it asks for one
+// with ?format_prices=true.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	unit, rate, convert, err := parseCurrency(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	printer, err := parsePriceFormat(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if convert {
+		convertPrices(v, unit, rate)
+	}
+	if printer != nil {
+		addPriceDisplay(v, printer)
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), jsonAPIMediaType) {
+		if doc, ok := toJSONAPI(r, v); ok {
+			w.Header().Set("Content-Type", jsonAPIMediaType)
+			json.NewEncoder(w).Encode(doc)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// toJSONAPI converts the supported response types to a JSON:API document. A product page
+// with a next cursor links to the next page: r's URL with the cursor in place of any offset.
+func toJSONAPI(r *http.Request, v interface{}) (jsonAPIDocument, bool) {
+	switch v := v.(type) {
+	case *Product:
+		return jsonAPIDocument{Data: productResource(v.ASIN, v)}, true
+	case []Product:
+		data := make([]jsonAPIResource, len(v))
+		for i := range v {
+			data[i] = productResource(v[i].ASIN, v[i])
+		}
+		return jsonAPIDocument{Data: data}, true
+	case []SearchResult:
+		data := make([]jsonAPIResource, len(v))
+		for i := range v {
+			data[i] = productResource(v[i].ASIN, v[i])
+		}
+		return jsonAPIDocument{Data: data}, true
+	case ProductPage:
+		doc, _ := toJSONAPI(r, v.Products)
+		doc.Meta = map[string]interface{}{"limit": v.Limit, "offset": v.Offset, "total": v.Total}
+		if v.NextCursor != "" {
+			doc.Meta["nextCursor"] = v.NextCursor
+			query := r.URL.Query()
+			query.Del("offset")
+			query.Set("cursor", v.NextCursor)
+			next := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+			doc.Links = map[string]string{"next": next.String()}
+		}
+		return doc, true
+	case []Category:
+		data := make([]jsonAPIResource, len(v))
+		for i, category := range v {
+			data[i] = jsonAPIResource{
+				Type:       "categories",
+				ID:         category.Name,
+				Attributes: map[string]interface{}{},
+				Links:      map[string]string{"self": "/categories/" + url.PathEscape(category.Name)},
+			}
+		}
+		return jsonAPIDocument{Data: data}, true
+	case []CategoryWithCount:
+		data := make([]jsonAPIResource, len(v))
+		for i, category := range v {
+			data[i] = jsonAPIResource{
+				Type:       "categories",
+				ID:         category.Name,
+				Attributes: map[string]interface{}{"count": category.Count},
+				Links:      map[string]string{"self": "/categories/" + url.PathEscape(category.Name)},
+			}
+		}
+		return jsonAPIDocument{Data: data}, true
+	}
+	return jsonAPIDocument{}, false
+}
+
+// productResource builds a "products" resource. The attributes are the product's regular
+// JSON fields without the asin, which becomes the resource id.
+func productResource(asin string, product interface{}) jsonAPIResource {
+	var attributes map[string]interface{}
+	b, _ := json.Marshal(product)
+	json.Unmarshal(b, &attributes)
+	delete(attributes, "asin")
+
+	return jsonAPIResource{
+		Type:       "products",
+		ID:         asin,
+		Attributes: attributes,
+		Links:      map[string]string{"self": "/products/" + url.PathEscape(asin)},
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// newLogger returns a logger that writes one JSON object per line to stderr, at the level
+// named by level: debug, info, warn or error. An empty or unknown level means info. Entries
+// logged with a request's context, e.g. slog.ErrorContext(r.Context(), ...), carry its
+// request_id.
+func newLogger(level string) *slog.Logger {
+	var lvl slog.Level
+	invalid := false
+	if level != "" {
+		invalid = lvl.UnmarshalText([]byte(level)) != nil
+	}
+
+	logger := slog.New(requestIDHandler{slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: lvl})})
+	if invalid {
+		logger.Warn("invalid LOG_LEVEL, using info", "value", level)
+	}
+	return logger
+}
+
+// fatal logs msg and its key/value pairs at error level, then exits like log.Fatal.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logRequests logs one entry per request with its method, path, response status and
+// duration, e.g. {"msg":"request","method":"GET","path":"/categories","status":200,"duration_ms":12,"request_id":"..."}.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
+
+type requestIDKey struct{}
+
+// withRequestID gives every request an ID, taken from its X-Request-ID header when the client
+// or a proxy sent a usable one and generated otherwise. The ID is echoed in the X-Request-ID
+// response header and stored in the request context for the logs, see requestIDHandler.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID accepts IDs of up to 128 printable ASCII characters, so a client cannot
+// inject anything odd into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDFrom returns the ID withRequestID assigned to the request ctx belongs to, or "".
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDHandler adds the request_id attribute to entries logged with a request's context.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
@@ -1,17 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"math/rand"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/mhmmdab09/hacka/config"
+	"golang.org/x/text/currency"
 )
 
 // Product represents a product in the database.
@@ -26,6 +38,9 @@ type Product struct {
 	IsBestSeller      bool    `json:"isBestSeller"`
 	BoughtInLastMonth int     `json:"boughtInLastMonth"`
 	CategoryName      string  `json:"categoryName"`
+	Available         *int    `json:"available,omitempty"`
+	PriceDisplay      string  `json:"price_display,omitempty"`
+	Currency          string  `json:"currency,omitempty"`
 }
 
 // Category represents a product category.
@@ -33,201 +48,3317 @@ type Category struct {
 	Name string `json:"name"`
 }
 
+// CategoryWithCount is a category and the number of products in it.
+type CategoryWithCount struct {
+	Category
+	Count int `json:"count"`
+}
+
 // Request structures for the APIs
 type AddItemToBasketRequest struct {
 	ProductID string `json:"product-id"`
 	UserID    string `json:"user-id"`
 	BasketID  string `json:"basket-id"`
+	// Quantity is optional and defaults to 1
+	Quantity int `json:"quantity"`
+}
+
+type CheckoutBasketRequest struct {
+	UserID   string `json:"user-id"`
+	BasketID string `json:"basket-id"`
+}
+
+// TransferBasketRequest moves a basket from one user to another, e.g. from the random user
+// ID of a guest to the account they logged in to.
+type TransferBasketRequest struct {
+	BasketID   string `json:"basket-id"`
+	FromUserID string `json:"from-user-id"`
+	ToUserID   string `json:"to-user-id"`
+}
+
+// UpdateBasketItemRequest sets the number of units of a product in a basket.
+type UpdateBasketItemRequest struct {
+	Quantity *int `json:"quantity"`
+}
+
+// BasketItem is a product and the number of units of it.
+type BasketItem struct {
+	ProductID string `json:"product-id"`
+	Quantity  int    `json:"quantity"`
+}
+
+// totalQuantity returns the number of units across items.
+func totalQuantity(items []BasketItem) int {
+	total := 0
+	for _, item := range items {
+		total += item.Quantity
+	}
+	return total
+}
+
+type ReserveBundleRequest struct {
+	UserID string       `json:"user-id"`
+	Items  []BasketItem `json:"items"`
+}
+
+type AddItemsToBasketRequest struct {
+	UserID   string       `json:"user-id"`
+	BasketID string       `json:"basket-id"`
+	Items    []BasketItem `json:"items"`
+}
+
+// BasketItemResult reports what happened to one item of a bulk add. Status is "added",
+// "out_of_stock", "not_found", or "rolled_back" for an item that was available but not
+// added because another item failed.
+type BasketItemResult struct {
+	ProductID string `json:"product-id"`
+	Quantity  int    `json:"quantity"`
+	Status    string `json:"status"`
+	Available *int   `json:"available,omitempty"`
+}
+
+type ProductsByCategoriesRequest struct {
+	Categories  []string `json:"categories"`
+	PerCategory int      `json:"per_category"`
+}
+
+type CreateCategoryRequest struct {
+	Name           string `json:"name"`
+	ParentCategory string `json:"parentCategory,omitempty"`
+}
+
+// InventoryAdjustment either changes a product's stock by Delta or sets it to Count.
+type InventoryAdjustment struct {
+	Delta *int `json:"delta"`
+	Count *int `json:"count"`
+}
+
+type ReassignCategoryRequest struct {
+	ASINs    []string `json:"asins"`
+	Category string   `json:"category"`
 }
 
-type CheckoutBasketRequest struct {
-	UserID   string `json:"user-id"`
-	BasketID string `json:"basket-id"`
+// BasketLine is a product in a basket and how many units of it the basket holds.
+type BasketLine struct {
+	Product
+	Quantity int `json:"quantity"`
+}
+
+// LowStockProduct is a product together with its remaining stock.
+type LowStockProduct struct {
+	Product
+	Count int `json:"count"`
+}
+
+// ProductPage is one page of a paginated product listing.
+type ProductPage struct {
+	Products []Product `json:"products"`
+	Limit    int       `json:"limit"`
+	Offset   int       `json:"offset"`
+	Total    int       `json:"total"`
+	// NextCursor continues a listing ordered by ASIN after this page; it is empty on the
+	// last page and for other orders.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// Readiness is the body of GET /healthz and GET /readyz.
+type Readiness struct {
+	Status            string   `json:"status"`
+	Database          string   `json:"database,omitempty"`
+	PendingMigrations []string `json:"pendingMigrations,omitempty"`
+}
+
+// BasketWeight is the estimated shipping weight of a basket.
+type BasketWeight struct {
+	BasketID           string  `json:"basketId"`
+	Weight             float64 `json:"weight"`
+	ItemsMissingWeight int     `json:"itemsMissingWeight"`
+}
+
+// UserSpend is how much a user has spent across their checked-out baskets.
+type UserSpend struct {
+	UserID       string  `json:"userId"`
+	TotalSpend   float64 `json:"totalSpend"`
+	OrderCount   int     `json:"orderCount"`
+	LargestOrder float64 `json:"largestOrder"`
+}
+
+// Basket is a basket with its owner, checkout status, items and total price.
+type Basket struct {
+	BasketID     string       `json:"basketId"`
+	UserID       string       `json:"userId"`
+	IsCheckedOut bool         `json:"isCheckedOut"`
+	Items        []BasketLine `json:"items"`
+	Total        float64      `json:"total"`
+	// Version is the basket's version, see bumpBasketVersion.
+	Version int64 `json:"version,omitempty"`
+}
+
+// addItem adds a line to the basket and its price to the total.
+func (b *Basket) addItem(item BasketLine) {
+	b.Items = append(b.Items, item)
+	b.Total += float64(item.Price) * float64(item.Quantity)
+}
+
+// CheckoutReadiness reports whether a basket can be checked out and, if not, why.
+type CheckoutReadiness struct {
+	BasketID    string           `json:"basketId"`
+	CanCheckout bool             `json:"canCheckout"`
+	Reasons     []BlockingReason `json:"reasons"`
+}
+
+// BlockingReason is one problem preventing checkout, with the ASINs it applies to.
+type BlockingReason struct {
+	Code  string   `json:"code"`
+	ASINs []string `json:"asins,omitempty"`
+}
+
+func main() {
+	// Settings from CONFIG_FILE and the environment, see config.Config
+	cfg, err := config.Load()
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	// Log JSON to stderr, at LOG_LEVEL (debug, info, warn or error)
+	slog.SetDefault(newLogger(cfg.LogLevel))
+
+	// Time every query for the db_query_duration_seconds metric
+	connector, err := pq.NewConnector(cfg.DatabaseURL)
+	if err != nil {
+		fatal("cannot open the database", "error", err)
+	}
+	db := sql.OpenDB(instrumentedConnector{connector})
+	defer db.Close()
+
+	// Connection pool limits
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.DBConnMaxLifetime))
+	slog.Info("database pool", "max_open", cfg.DBMaxOpenConns, "max_idle", cfg.DBMaxIdleConns, "max_lifetime", time.Duration(cfg.DBConnMaxLifetime).String())
+
+	// Test the database connection
+	err = db.Ping()
+	if err != nil {
+		fatal("cannot connect to the database", "error", err)
+	}
+
+	// Create any missing tables in a fresh database
+	if cfg.RunMigrations {
+		if err := runMigrations(context.Background(), db); err != nil {
+			fatal("migrations failed", "error", err)
+		}
+	}
+
+	// Product views are written in batches; flush whatever is left when the process is stopped
+	views := newViewRecorder(db, cfg.ViewBatchSize, time.Duration(cfg.ViewFlushInterval))
+	defer views.Close()
+
+	readOnlyMode = cfg.ReadOnly
+	if readOnlyMode {
+		slog.Warn("READ_ONLY is set, mutating requests are rejected")
+	}
+	readRetry = RetryPolicy{
+		MaxAttempts: cfg.DBRetryMaxAttempts,
+		BaseDelay:   time.Duration(cfg.DBRetryBaseDelay),
+	}
+	titleCaseCategories = cfg.CategoryTitleCase
+	maxFilters = cfg.MaxFilters
+	if v := cfg.PriceCurrency; v != "" {
+		unit, err := currency.ParseISO(v)
+		if err != nil {
+			fatal("invalid PRICE_CURRENCY", "value", v, "error", err)
+		}
+		priceCurrency = unit
+	}
+	if v := cfg.ExchangeRates; v != "" {
+		rates, err := parseExchangeRates(v)
+		if err != nil {
+			fatal("invalid EXCHANGE_RATES", "value", v, "error", err)
+		}
+		exchangeRates = rates
+	}
+
+	// Sign login tokens with JWT_SECRET; without it tokens do not survive a restart
+	if cfg.JWTSecret == "" {
+		slog.Warn("JWT_SECRET is not set, using a random secret")
+	}
+	tokens := NewTokenIssuer(cfg.JWTSecret, time.Duration(cfg.JWTTTL))
+
+	r := mux.NewRouter()
+
+	// Answer unknown routes and methods with the same JSON errors as the handlers
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, ErrNotFound)
+	})
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+	})
+
+	// Count requests per route for the admin metrics endpoint and for Prometheus
+	metrics := NewMetrics()
+	prometheusMetrics := NewPrometheusMetrics(db)
+	r.Use(observeRequests(metrics, prometheusMetrics))
+
+	// Every write but logging in, registering and reading products by category needs the
+	// X-API-Key header when API_KEY is set
+	r.Use(requireAPIKeyForWrites(cfg.APIKey))
+
+	// Identify the user behind a bearer token; basket and order routes check it against their user
+	r.Use(authenticate(tokens))
+
+	// Cancel database queries that outlive QUERY_TIMEOUT
+	r.Use(withQueryTimeout(time.Duration(cfg.QueryTimeout)))
+
+	// Define the route for the liveness probe; it only shows that the process is serving
+	r.HandleFunc("/healthz", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(Readiness{Status: "ok"})
+	})).Methods("GET")
+
+	// Define the route for the readiness probe, failing while the database is unreachable or
+	// behind the migrations this build expects
+	r.HandleFunc("/readyz", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := db.PingContext(ctx); err != nil {
+			slog.WarnContext(r.Context(), "readiness check failed", "error", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(Readiness{Status: "unavailable", Database: "unreachable"})
+			return
+		}
+
+		pending, err := pendingMigrations(ctx, db)
+		if err != nil {
+			slog.WarnContext(r.Context(), "readiness check failed", "error", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(Readiness{Status: "unavailable", Database: "unreachable"})
+			return
+		}
+		if len(pending) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(Readiness{Status: "unavailable", Database: "ok", PendingMigrations: pending})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Readiness{Status: "ok", Database: "ok"})
+	})).Methods("GET")
+
+	// Define the route for Prometheus to scrape request and connection pool metrics
+	r.HandleFunc("/metrics", readOnly(prometheusMetrics.Handler().ServeHTTP)).Methods("GET")
+
+	// Define the route to get the OpenAPI description of this API
+	r.HandleFunc("/openapi.json", readOnly(serveOpenAPI())).Methods("GET")
+
+	// Categories are ordered with this collation when set, e.g. "en-US-x-icu"
+	categoryCollation := cfg.CategoryCollation
+	categoryCache := NewCategoryCache(db, time.Duration(cfg.CategoriesCacheTTL), categoryCollation)
+
+	// Define the route to get all categories
+	r.HandleFunc("/categories", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		descending := false
+		switch r.URL.Query().Get("sort") {
+		case "", "name", "name_asc":
+		case "name_desc":
+			descending = true
+		default:
+			writeError(w, r, http.StatusBadRequest, ErrInvalidSort)
+			return
+		}
+
+		// Counts change with every product write, so they bypass the category cache
+		if r.URL.Query().Get("withCounts") == "true" {
+			categories, err := getCategoriesWithCounts(r.Context(), db, descending, categoryCollation)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			writeJSON(w, r, categories)
+			return
+		}
+
+		categories, err := categoryCache.Get(r.Context(), descending)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, r, categories)
+	})).Methods("GET")
+
+	// Define the route to get the categories arranged under their parent categories
+	r.HandleFunc("/categories/tree", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		tree, err := getCategoryTree(r.Context(), db)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tree)
+	})).Methods("GET")
+
+	// Define the route to get products by category
+	r.HandleFunc("/categories/{category}", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		category := normalizeCategory(vars["category"])
+		if category == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingCategory)
+			return
+		}
+
+		filter, err := parseProductFilter(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		limit, err := parseLimit(r, 20, 100)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		offset, err := parseOffset(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		sort, err := parseProductSort(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		// A cursor replaces the offset and only works with the default order
+		cursor, err := parseCursor(r)
+		if err != nil || (cursor != "" && (sort != "" || offset != 0)) {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidCursor)
+			return
+		}
+
+		var page ProductPage
+		err = readRetry.Do(r.Context(), func() (err error) {
+			page, err = getProductsByCategory(r.Context(), db, category, filter, sort, wantsInclude(r, "stock"), limit, offset, cursor)
+			return err
+		})
+		if err != nil {
+			if err == ErrCategoryNotFound {
+				writeError(w, r, http.StatusNotFound, err)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, r, page)
+	})).Methods("GET")
+
+	// Define the route to get aggregate figures for the products of a category
+	r.HandleFunc("/categories/{category}/stats", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		category := normalizeCategory(vars["category"])
+		if category == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingCategory)
+			return
+		}
+
+		stats, err := getCategoryStats(r.Context(), db, category)
+		if err != nil {
+			if err == ErrCategoryNotFound {
+				writeError(w, r, http.StatusNotFound, err)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})).Methods("GET")
+
+	// Define the route to get the products of several categories in one listing
+	r.HandleFunc("/products", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		categories := normalizeCategories(strings.Split(r.URL.Query().Get("categories"), ","))
+		if len(categories) == 0 {
+			writeError(w, r, http.StatusBadRequest, ErrMissingCategory)
+			return
+		}
+		if len(categories) > maxCategoriesPerRequest {
+			writeError(w, r, http.StatusBadRequest, ErrTooManyCategories)
+			return
+		}
+
+		filter, err := parseProductFilter(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		limit, err := parseLimit(r, 20, 100)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		offset, err := parseOffset(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		sort, err := parseProductSort(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		page, err := getProductsInCategories(r.Context(), db, categories, filter, sort, wantsInclude(r, "stock"), limit, offset)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, r, page)
+	})).Methods("GET")
+
+	// Define the route to search product titles and categories with Postgres full-text search
+	r.HandleFunc("/products/search", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		if query == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingQuery)
+			return
+		}
+
+		limit, err := parseLimit(r, 20, 100)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		offset, err := parseOffset(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		filter, err := parseProductFilter(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		category := normalizeCategory(r.URL.Query().Get("category"))
+
+		var results []SearchResult
+		err = readRetry.Do(r.Context(), func() (err error) {
+			results, err = fullTextSearch(r.Context(), db, query, category, filter, limit, offset, wantsInclude(r, "stock"))
+			return err
+		})
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, r, results)
+	})).Methods("GET")
+
+	// Define the route to get the newest products
+	r.HandleFunc("/products/new", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		limit, err := parseLimit(r, 20, 100)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		offset, err := parseOffset(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		filter, err := parseProductFilter(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		page, err := getNewProducts(r.Context(), db, filter, limit, offset)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, r, page)
+	})).Methods("GET")
+
+	// Define the route to get a stable sample of products for an experiment
+	r.HandleFunc("/products/sample", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		seed := r.URL.Query().Get("seed")
+		if seed == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingSeed)
+			return
+		}
+
+		fraction, err := strconv.ParseFloat(r.URL.Query().Get("fraction"), 64)
+		if err != nil || !(fraction > 0 && fraction <= 1) {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidFraction)
+			return
+		}
+
+		limit, err := parseLimit(r, 20, 100)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		products, err := getDeterministicSample(r.Context(), db, seed, fraction, limit)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, r, products)
+	})).Methods("GET")
+
+	// Define the route to get the best-selling products for the homepage
+	r.HandleFunc("/best-sellers", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		limit, err := parseLimit(r, 10, 50)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		products, err := getBestSellers(r.Context(), db, limit)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, r, products)
+	})).Methods("GET")
+
+	// Define the route to get a few products from each of several categories
+	r.HandleFunc("/products/by-categories", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		var req ProductsByCategoriesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+
+		categories := normalizeCategories(req.Categories)
+		if len(categories) == 0 {
+			writeError(w, r, http.StatusBadRequest, ErrMissingCategory)
+			return
+		}
+		if len(categories) > maxCategoriesPerRequest {
+			writeError(w, r, http.StatusBadRequest, ErrTooManyCategories)
+			return
+		}
+
+		perCategory := req.PerCategory
+		if perCategory == 0 {
+			perCategory = 5
+		}
+		if perCategory < 0 || perCategory > 50 {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPerCategory)
+			return
+		}
+
+		products, err := getProductsByCategories(r.Context(), db, categories, perCategory)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(products)
+	})).Methods("POST")
+
+	// Define the route to get a single product
+	r.HandleFunc("/products/{asin}", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		asin := vars["asin"]
+
+		var product *Product
+		err := readRetry.Do(r.Context(), func() (err error) {
+			product, err = getProductByASIN(r.Context(), db, asin)
+			return err
+		})
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeError(w, r, http.StatusNotFound, ErrProductNotFound)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		// Views are buffered and written in batches so they never slow down the response
+		if userID := r.URL.Query().Get("user-id"); userID != "" {
+			views.Add(userID, asin, time.Now())
+		}
+
+		writeJSON(w, r, product)
+	})).Methods("GET")
+
+	// Define the route to get a QR code linking to a product
+	qrCodes := NewQRCache()
+	r.HandleFunc("/products/{asin}/qr", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		asin := vars["asin"]
+
+		size := 256
+		if v := r.URL.Query().Get("size"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 64 || n > 1024 {
+				writeError(w, r, http.StatusBadRequest, ErrInvalidSize)
+				return
+			}
+			size = n
+		}
+
+		var product *Product
+		err := readRetry.Do(r.Context(), func() (err error) {
+			product, err = getProductByASIN(r.Context(), db, asin)
+			return err
+		})
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeError(w, r, http.StatusNotFound, ErrProductNotFound)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		png, err := qrCodes.Get(product, size)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(len(png)))
+		w.Write(png)
+	})).Methods("GET")
+
+	// Define the route to get the products a user viewed most recently
+	r.HandleFunc("/users/{userID}/recently-viewed", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		userID := vars["userID"]
+
+		limit, err := parseLimit(r, 10, maxViewsPerUser)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		products, err := getRecentlyViewed(r.Context(), db, userID, limit)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, r, products)
+	})).Methods("GET")
+
+	// Define the route to get products frequently bought together with a product
+	r.HandleFunc("/products/{asin}/bought-together", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		asin := vars["asin"]
+
+		limit, err := parseLimit(r, 10, 50)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		products, err := getFrequentlyBoughtTogether(r.Context(), db, asin, limit)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, r, products)
+	})).Methods("GET")
+
+	// Define the route to search products by title
+	r.HandleFunc("/search", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("q")
+		if query == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingQuery)
+			return
+		}
+
+		rank := r.URL.Query().Get("rank")
+		if rank == "" {
+			rank = "blended"
+		}
+		if !searchRankings[rank] {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidRank)
+			return
+		}
+
+		limit, err := parseLimit(r, 20, 100)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		filter, err := parseProductFilter(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		var results []SearchResult
+		err = readRetry.Do(r.Context(), func() (err error) {
+			results, err = searchProducts(r.Context(), db, query, rank, filter, limit, wantsInclude(r, "stock"))
+			return err
+		})
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, r, results)
+	})).Methods("GET")
+
+	// Define the route to get the contents of one of a user's baskets
+	r.HandleFunc("/baskets/{basketID}", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		basketID := vars["basketID"]
+
+		userID := r.URL.Query().Get("user-id")
+		if userID == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingUserID)
+			return
+		}
+		if !authorizeUser(w, r, db, userID) {
+			return
+		}
+
+		basket, err := getUserBasket(r.Context(), db, userID, basketID)
+		if err != nil {
+			if err == ErrBasketNotFound {
+				writeError(w, r, http.StatusNotFound, err)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		basket.Version, err = getBasketVersion(r.Context(), db, basketID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		setBasketETag(w, basket.Version)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(basket)
+	})).Methods("GET")
+
+	// Define the route to change the number of units of a product in a user's basket
+	r.HandleFunc("/baskets/{basketID}/items/{asin}", mutating(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		basketID, asin := vars["basketID"], vars["asin"]
+
+		userID := r.URL.Query().Get("user-id")
+		if userID == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingUserID)
+			return
+		}
+		if !authorizeUser(w, r, db, userID) {
+			return
+		}
+
+		var req UpdateBasketItemRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+		if req.Quantity == nil || *req.Quantity < 0 {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidQuantity)
+			return
+		}
+
+		expected, err := parseIfMatch(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		version, err := setBasketItemQuantity(r.Context(), db, userID, basketID, asin, *req.Quantity, expected)
+		if err != nil {
+			var stockErr *StockError
+			switch {
+			case errors.As(err, &stockErr):
+				writeStockError(w, r, stockErr)
+			case err == ErrItemNotInBasket, err == ErrProductNotFound, err == ErrBasketNotFound:
+				writeError(w, r, http.StatusNotFound, err)
+			case err == ErrStaleBasket:
+				writeError(w, r, http.StatusConflict, err)
+			default:
+				writeError(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		basket, err := getUserBasket(r.Context(), db, userID, basketID)
+		if err != nil && err != ErrBasketNotFound {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		basket.BasketID, basket.UserID, basket.Version = basketID, userID, version
+
+		setBasketETag(w, version)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(basket)
+	})).Methods("PATCH")
+
+	// Define the route to remove a product from a user's basket
+	r.HandleFunc("/baskets/{basketID}/items/{asin}", mutating(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		basketID, asin := vars["basketID"], vars["asin"]
+
+		userID := r.URL.Query().Get("user-id")
+		if userID == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingUserID)
+			return
+		}
+		if !authorizeUser(w, r, db, userID) {
+			return
+		}
+
+		expected, err := parseIfMatch(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		version, err := setBasketItemQuantity(r.Context(), db, userID, basketID, asin, 0, expected)
+		if err != nil {
+			switch err {
+			case ErrItemNotInBasket, ErrBasketNotFound:
+				writeError(w, r, http.StatusNotFound, err)
+			case ErrStaleBasket:
+				writeError(w, r, http.StatusConflict, err)
+			default:
+				writeError(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		setBasketETag(w, version)
+		w.WriteHeader(http.StatusNoContent)
+	})).Methods("DELETE")
+
+	// Define the route to get the contents of a basket
+	r.HandleFunc("/basket/{basketID}", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		basketID := vars["basketID"]
+		owner, ok := authorizeBasket(w, r, db, basketID)
+		if !ok {
+			return
+		}
+
+		basket, err := getBasket(r.Context(), db, owner, basketID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		basket.Version, err = getBasketVersion(r.Context(), db, basketID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		setBasketETag(w, basket.Version)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(basket)
+	})).Methods("GET")
+
+	// Define the route to estimate the shipping weight of a basket
+	r.HandleFunc("/basket/{basketID}/weight", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		basketID := vars["basketID"]
+		owner, ok := authorizeBasket(w, r, db, basketID)
+		if !ok {
+			return
+		}
+
+		weight, err := getBasketWeight(r.Context(), db, owner, basketID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(weight)
+	})).Methods("GET")
+
+	// Define the route to list a user's past orders
+	r.HandleFunc("/users/{userID}/orders", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		userID := mux.Vars(r)["userID"]
+		if !authorizeUser(w, r, db, userID) {
+			return
+		}
+
+		orders, err := getOrders(r.Context(), db, userID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, r, orders)
+	})).Methods("GET")
+
+	// Define the route to get one of a user's orders
+	r.HandleFunc("/orders/{orderID}", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		orderID, err := strconv.ParseInt(mux.Vars(r)["orderID"], 10, 64)
+		if err != nil || orderID <= 0 {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidOrderID)
+			return
+		}
+
+		userID := r.URL.Query().Get("user-id")
+		if userID == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingUserID)
+			return
+		}
+		if !authorizeUser(w, r, db, userID) {
+			return
+		}
+
+		order, err := getOrder(r.Context(), db, userID, orderID)
+		if err != nil {
+			if err == ErrOrderNotFound {
+				writeError(w, r, http.StatusNotFound, err)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(order)
+	})).Methods("GET")
+
+	// Define the route to cancel a checked-out order and put its items back in stock
+	cancellationWindow := time.Duration(cfg.CancellationWindow)
+	r.HandleFunc("/users/{userID}/orders/{basketID}/cancel", mutating(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		userID := vars["userID"]
+		basketID := vars["basketID"]
+		if !authorizeUser(w, r, db, userID) {
+			return
+		}
+
+		err := cancelOrder(r.Context(), db, userID, basketID, cancellationWindow)
+		if err != nil {
+			switch err {
+			case ErrOrderNotFound:
+				writeError(w, r, http.StatusNotFound, err)
+			case ErrNotCheckedOut, ErrAlreadyCancelled, ErrCancellationWindowPassed:
+				writeError(w, r, http.StatusConflict, err)
+			default:
+				writeError(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Order cancelled successfully"))
+	})).Methods("POST")
+
+	// Define the route to check whether a basket is ready for checkout
+	r.HandleFunc("/basket/{basketID}/can-checkout", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		basketID := vars["basketID"]
+		owner, ok := authorizeBasket(w, r, db, basketID)
+		if !ok {
+			return
+		}
+
+		readiness, err := canCheckout(r.Context(), db, owner, basketID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(readiness)
+	})).Methods("GET")
+
+	// Define the route to add an item to the basket
+	r.HandleFunc("/add-item-to-basket", mutating(func(w http.ResponseWriter, r *http.Request) {
+		var req AddItemToBasketRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+		if !authorizeUser(w, r, db, req.UserID) {
+			return
+		}
+
+		expected, err := parseIfMatch(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if req.Quantity == 0 {
+			req.Quantity = 1
+		}
+		if req.Quantity < 0 {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidQuantity)
+			return
+		}
+
+		version, err := addItemToBasket(r.Context(), db, req.ProductID, req.UserID, req.BasketID, req.Quantity, expected)
+		if err != nil {
+			var stockErr *StockError
+			if errors.As(err, &stockErr) {
+				writeStockError(w, r, stockErr)
+				return
+			}
+			if err == ErrBasketNotFound {
+				writeError(w, r, http.StatusNotFound, err)
+				return
+			}
+			if err == ErrStaleBasket {
+				writeError(w, r, http.StatusConflict, err)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		prometheusMetrics.ItemsAdded(req.Quantity)
+		setBasketETag(w, version)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Item added to basket"))
+	})).Methods("POST")
+
+	// Define the route to remove an item from the basket
+	r.HandleFunc("/remove-item-from-basket", mutating(func(w http.ResponseWriter, r *http.Request) {
+		var req AddItemToBasketRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+		if !authorizeUser(w, r, db, req.UserID) {
+			return
+		}
+
+		expected, err := parseIfMatch(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		version, err := removeItemFromBasket(r.Context(), db, req.ProductID, req.UserID, req.BasketID, expected)
+		if err != nil {
+			switch err {
+			case ErrItemNotInBasket, ErrBasketNotFound:
+				writeError(w, r, http.StatusNotFound, err)
+			case ErrStaleBasket:
+				writeError(w, r, http.StatusConflict, err)
+			default:
+				writeError(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		setBasketETag(w, version)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Item removed from basket"))
+	})).Methods("POST")
+
+	// Define the route to remove every item from the basket
+	r.HandleFunc("/clear-basket", mutating(func(w http.ResponseWriter, r *http.Request) {
+		var req CheckoutBasketRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+		if !authorizeUser(w, r, db, req.UserID) {
+			return
+		}
+
+		expected, err := parseIfMatch(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		removed, version, err := clearBasket(r.Context(), db, req.UserID, req.BasketID, expected)
+		if err != nil {
+			switch err {
+			case ErrBasketNotFound:
+				writeError(w, r, http.StatusNotFound, err)
+			case ErrStaleBasket:
+				writeError(w, r, http.StatusConflict, err)
+			default:
+				writeError(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		setBasketETag(w, version)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"basket-id": req.BasketID,
+			"removed":   removed,
+		})
+	})).Methods("POST")
+
+	// Define the route to move a guest's basket to the account they logged in to
+	r.HandleFunc("/transfer-basket", mutating(func(w http.ResponseWriter, r *http.Request) {
+		var req TransferBasketRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+		if req.FromUserID == "" || req.ToUserID == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingUserID)
+			return
+		}
+		if !authorizeUser(w, r, db, req.ToUserID) {
+			return
+		}
+		// Only guest baskets can be transferred; an account's basket stays with its owner
+		if registered, err := isRegisteredUser(r.Context(), db, req.FromUserID); err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		} else if registered && req.FromUserID != req.ToUserID {
+			writeError(w, r, http.StatusForbidden, ErrForbidden)
+			return
+		}
+
+		expected, err := parseIfMatch(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		transferred, version, err := transferBasket(r.Context(), db, req.BasketID, req.FromUserID, req.ToUserID, expected)
+		if err != nil {
+			switch err {
+			case ErrEmptyBasket, ErrBasketNotFound:
+				writeError(w, r, http.StatusNotFound, err)
+			case ErrStaleBasket, ErrAlreadyCheckedOut:
+				writeError(w, r, http.StatusConflict, err)
+			default:
+				writeError(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		setBasketETag(w, version)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"basket-id":   req.BasketID,
+			"transferred": transferred,
+		})
+	})).Methods("POST")
+
+	// Define the route to create a user account and log it in. It writes to "Users", so
+	// READ_ONLY mode refuses it like every other write
+	r.HandleFunc("/register", mutating(func(w http.ResponseWriter, r *http.Request) {
+		var creds Credentials
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+		if err := creds.validate(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		userID, err := createUser(r.Context(), db, creds.Email, creds.Password)
+		if err != nil {
+			if err == ErrUserExists {
+				writeError(w, r, http.StatusConflict, err)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		token, expiresAt, err := tokens.Issue(userID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(AuthResponse{UserID: userID, Token: token, ExpiresAt: expiresAt})
+	})).Methods("POST")
+
+	// Define the route to exchange an email and password for a token
+	r.HandleFunc("/login", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		var creds Credentials
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+
+		userID, err := authenticateUser(r.Context(), db, creds.Email, creds.Password)
+		if err != nil {
+			if err == ErrInvalidCredentials {
+				writeError(w, r, http.StatusUnauthorized, err)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		token, expiresAt, err := tokens.Issue(userID)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthResponse{UserID: userID, Token: token, ExpiresAt: expiresAt})
+	})).Methods("POST")
+
+	// Define the route to add a bundle of products to a basket all at once
+	r.HandleFunc("/basket/{basketID}/reserve-bundle", mutating(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		basketID := vars["basketID"]
+
+		var req ReserveBundleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+		if !authorizeUser(w, r, db, req.UserID) {
+			return
+		}
+		if len(req.Items) == 0 {
+			writeError(w, r, http.StatusBadRequest, ErrMissingItems)
+			return
+		}
+		for i := range req.Items {
+			if req.Items[i].Quantity == 0 {
+				req.Items[i].Quantity = 1
+			}
+			if req.Items[i].Quantity < 0 {
+				writeError(w, r, http.StatusBadRequest, ErrInvalidQuantity)
+				return
+			}
+		}
+
+		expected, err := parseIfMatch(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		version, err := reserveMultiple(r.Context(), db, req.UserID, basketID, req.Items, expected)
+		if err != nil {
+			var bundleErr *BundleError
+			if errors.As(err, &bundleErr) {
+				writeBundleError(w, r, bundleErr)
+				return
+			}
+			if err == ErrBasketNotFound {
+				writeError(w, r, http.StatusNotFound, err)
+				return
+			}
+			if err == ErrStaleBasket {
+				writeError(w, r, http.StatusConflict, err)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		prometheusMetrics.ItemsAdded(totalQuantity(req.Items))
+		setBasketETag(w, version)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Bundle added to basket"))
+	})).Methods("POST")
+
+	// Define the route to add several items to a basket at once, e.g. to restore a saved cart.
+	// Either every item is added or, if any is missing or short on stock, none is.
+	r.HandleFunc("/add-items-to-basket", mutating(func(w http.ResponseWriter, r *http.Request) {
+		var req AddItemsToBasketRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+		if !authorizeUser(w, r, db, req.UserID) {
+			return
+		}
+		if len(req.Items) == 0 {
+			writeError(w, r, http.StatusBadRequest, ErrMissingItems)
+			return
+		}
+		for i := range req.Items {
+			if req.Items[i].Quantity == 0 {
+				req.Items[i].Quantity = 1
+			}
+			if req.Items[i].Quantity < 0 {
+				writeError(w, r, http.StatusBadRequest, ErrInvalidQuantity)
+				return
+			}
+		}
+
+		expected, err := parseIfMatch(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		status := http.StatusCreated
+		version, err := reserveMultiple(r.Context(), db, req.UserID, req.BasketID, req.Items, expected)
+		var bundleErr *BundleError
+		if err != nil {
+			if !errors.As(err, &bundleErr) {
+				if err == ErrBasketNotFound {
+					writeError(w, r, http.StatusNotFound, err)
+					return
+				}
+				if err == ErrStaleBasket {
+					writeError(w, r, http.StatusConflict, err)
+					return
+				}
+				writeError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			status = http.StatusConflict
+		} else {
+			prometheusMetrics.ItemsAdded(totalQuantity(req.Items))
+			setBasketETag(w, version)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"basketId": req.BasketID,
+			"added":    bundleErr == nil,
+			"items":    basketItemResults(req.Items, bundleErr),
+		})
+	})).Methods("POST")
+
+	// Define the route to checkout a basket. A repeated Idempotency-Key replays the original
+	// result for IDEMPOTENCY_KEY_TTL instead of checking out again.
+	idempotencyKeyTTL := time.Duration(cfg.IdempotencyKeyTTL)
+	r.HandleFunc("/checkout-basket", mutating(func(w http.ResponseWriter, r *http.Request) {
+		var req CheckoutBasketRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+		if !authorizeUser(w, r, db, req.UserID) {
+			return
+		}
+
+		expected, err := parseIfMatch(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		idempotencyKey, err := parseIdempotencyKey(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		result, err := checkoutBasket(r.Context(), db, req.UserID, req.BasketID, expected, idempotencyKey, idempotencyKeyTTL)
+		if err == nil {
+			prometheusMetrics.CheckedOut()
+		}
+		if err == errReplayed {
+			result, err = getIdempotentResult(r.Context(), db, req.UserID, idempotencyKey)
+			if err == nil && result.BasketID != req.BasketID {
+				err = ErrIdempotencyKeyReused
+			}
+		}
+		if err != nil {
+			switch {
+			case err == ErrIdempotencyKeyReused:
+				writeError(w, r, http.StatusUnprocessableEntity, err)
+			case err == ErrEmptyBasket, err == ErrBasketNotFound:
+				writeError(w, r, http.StatusNotFound, err)
+			case err == ErrStaleBasket, err == ErrAlreadyCheckedOut, errors.Is(err, ErrProductNotFound):
+				writeError(w, r, http.StatusConflict, err)
+			default:
+				writeError(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		setBasketETag(w, result.Version)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})).Methods("POST")
+
+	// Admin routes require the X-API-Key header, as do the catalogue writes registered with
+	// adminOnly next to the public reads of the same resources
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAPIKey(cfg.APIKey))
+	adminOnly := requireAPIKey(cfg.APIKey)
+
+	// Define the route to create a category ahead of stocking it
+	r.Handle("/categories", adminOnly(mutating(func(w http.ResponseWriter, r *http.Request) {
+		var req CreateCategoryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+
+		req.Name = normalizeCategory(req.Name)
+		req.ParentCategory = normalizeCategory(req.ParentCategory)
+		if req.Name == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingCategory)
+			return
+		}
+		if strings.EqualFold(req.Name, req.ParentCategory) {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidParentCategory)
+			return
+		}
+
+		err := createCategory(r.Context(), db, req.Name, req.ParentCategory)
+		if err != nil {
+			if err == ErrCategoryExists {
+				writeError(w, r, http.StatusConflict, err)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		categoryCache.Invalidate()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(req)
+	}))).Methods("POST")
+
+	// Define the route to delete an empty category
+	r.Handle("/categories/{category}", adminOnly(mutating(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		category := normalizeCategory(vars["category"])
+		if category == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingCategory)
+			return
+		}
+
+		err := deleteCategory(r.Context(), db, category)
+		if err != nil {
+			switch err {
+			case ErrCategoryNotFound:
+				writeError(w, r, http.StatusNotFound, err)
+			case ErrCategoryNotEmpty:
+				writeError(w, r, http.StatusConflict, err)
+			default:
+				writeError(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		categoryCache.Invalidate()
+
+		w.WriteHeader(http.StatusNoContent)
+	}))).Methods("DELETE")
+
+	// Define the route to mark every product in a category as out of stock
+	admin.HandleFunc("/categories/{category}/zero-stock", mutating(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		category := normalizeCategory(vars["category"])
+		if category == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingCategory)
+			return
+		}
+
+		affected, err := setCategoryStockZero(r.Context(), db, category)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"category": category,
+			"affected": affected,
+		})
+	})).Methods("POST")
+
+	// Define the route to move a set of products to another category
+	admin.HandleFunc("/products/reassign-category", mutating(func(w http.ResponseWriter, r *http.Request) {
+		var req ReassignCategoryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+
+		category := normalizeCategory(req.Category)
+		if category == "" {
+			writeError(w, r, http.StatusBadRequest, ErrMissingCategory)
+			return
+		}
+		if len(req.ASINs) == 0 {
+			writeError(w, r, http.StatusBadRequest, ErrMissingASINs)
+			return
+		}
+
+		updated, missing, err := reassignProducts(r.Context(), db, req.ASINs, category)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		categoryCache.Invalidate()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"updated": updated,
+			"missing": missing,
+		})
+	})).Methods("POST")
+
+	// Define the route to read the in-memory request metrics. Resetting the counters touches
+	// no data, so the metrics stay readable in read-only mode, but the response is never cached.
+	admin.HandleFunc("/metrics", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		reset := r.URL.Query().Get("reset") == "true"
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(metrics.Snapshot(reset))
+	})).Methods("GET")
+
+	// Define the route to list the users who have spent the most
+	admin.HandleFunc("/top-spenders", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		limit, err := parseLimit(r, 20, 100)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		spenders, err := getTopSpenders(r.Context(), db, limit)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(spenders)
+	})).Methods("GET")
+
+	// Define the route to list products that are running out of stock
+	lowStockThreshold := cfg.LowStockThreshold
+	admin.HandleFunc("/products/low-stock", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		threshold, err := parseThreshold(r, lowStockThreshold)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		limit, err := parseLimit(r, 100, 500)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		products, err := getLowStockProducts(r.Context(), db, threshold, false, limit)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(products)
+	})).Methods("GET")
+
+	// Define the route to add a product to the catalogue with its initial stock
+	r.Handle("/products", adminOnly(mutating(func(w http.ResponseWriter, r *http.Request) {
+		var req ProductInput
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+
+		var validationErr *ValidationError
+		if err := req.validate(true); errors.As(err, &validationErr) {
+			writeValidationError(w, r, validationErr)
+			return
+		}
+
+		err := createProduct(r.Context(), db, req.Product, req.Count)
+		if err != nil {
+			if err == ErrProductExists {
+				writeError(w, r, http.StatusConflict, err)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		categoryCache.Invalidate()
+
+		product, err := getProductByASIN(r.Context(), db, req.ASIN)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/products/"+url.PathEscape(product.ASIN))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(product)
+	}))).Methods("POST")
+
+	// Define the route to update a product's details
+	r.Handle("/products/{asin}", adminOnly(mutating(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		asin := vars["asin"]
+
+		var req ProductInput
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+
+		var validationErr *ValidationError
+		if err := req.validate(false); errors.As(err, &validationErr) {
+			writeValidationError(w, r, validationErr)
+			return
+		}
+		if req.ASIN != "" && req.ASIN != asin {
+			writeValidationError(w, r, &ValidationError{Fields: map[string]string{"asin": "does not match the URL"}})
+			return
+		}
+		req.ASIN = asin
+
+		product, err := updateProduct(r.Context(), db, req.Product)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeError(w, r, http.StatusNotFound, ErrProductNotFound)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		categoryCache.Invalidate()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(product)
+	}))).Methods("PUT")
+
+	// Define the route to restock or correct a product's stock count
+	r.Handle("/products/{asin}/inventory", adminOnly(mutating(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		asin := vars["asin"]
+
+		var req InventoryAdjustment
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidPayload)
+			return
+		}
+		if (req.Delta == nil) == (req.Count == nil) {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidAdjustment)
+			return
+		}
+
+		delta := 0
+		if req.Delta != nil {
+			delta = *req.Delta
+		}
+
+		count, err := adjustInventory(r.Context(), db, asin, delta, req.Count)
+		if err != nil {
+			switch err {
+			case ErrProductNotFound:
+				writeError(w, r, http.StatusNotFound, err)
+			case ErrNegativeStock:
+				writeError(w, r, http.StatusConflict, err)
+			default:
+				writeError(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"asin":  asin,
+			"count": count,
+		})
+	}))).Methods("POST")
+
+	// Reports for the purchasing team also require the X-API-Key header
+	reports := r.PathPrefix("/reports").Subrouter()
+	reports.Use(requireAPIKey(cfg.APIKey))
+
+	// Define the route to list every product that needs reordering, including those already
+	// out of stock
+	reports.HandleFunc("/low-stock", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		threshold, err := parseThreshold(r, 5)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		limit, err := parseLimit(r, 1000, 10000)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		products, err := getLowStockProducts(r.Context(), db, threshold, true, limit)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(products)
+	})).Methods("GET")
+
+	allowedOrigins := cfg.AllowedOrigins
+	if allowedOrigins == "" {
+		allowedOrigins = "*"
+	}
+
+	// Rate limit each client IP; RATE_LIMIT_RPS=0 turns the limiter off
+	var handler http.Handler = r
+	if cfg.RateLimitRPS > 0 {
+		limiter := NewRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst, cfg.TrustProxy, 3*time.Minute)
+		defer limiter.Close()
+		handler = limiter.Middleware(handler)
+	}
+
+	// Serve HTTPS when TLS_CERT_FILE and TLS_KEY_FILE are both set, plain HTTP when neither is
+	certFile, keyFile := cfg.TLSCertFile, cfg.TLSKeyFile
+	// Listen on LISTEN_ADDR, e.g. "0.0.0.0:8080", or on PORT
+	listener, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		fatal("cannot listen", "addr", cfg.ListenAddr, "error", err)
+	}
+
+	server := &http.Server{
+		Addr:         cfg.ListenAddr,
+		Handler:      withRequestID(logRequests(cors(allowedOrigins, gzipResponses(handler)))),
+		TLSConfig:    &tls.Config{MinVersion: tls.VersionTLS12},
+		ReadTimeout:  time.Duration(cfg.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.WriteTimeout),
+		IdleTimeout:  time.Duration(cfg.IdleTimeout),
+	}
+
+	go func() {
+		var err error
+		if certFile != "" {
+			slog.Info("server is listening", "addr", listener.Addr().String(), "tls", true)
+			err = server.ServeTLS(listener, certFile, keyFile)
+		} else {
+			slog.Info("server is listening", "addr", listener.Addr().String(), "tls", false)
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("server failed", "error", err)
+		}
+	}()
+
+	// Wait for a stop signal, then give in-flight requests SHUTDOWN_TIMEOUT to finish before
+	// closing the database
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+
+	shutdownTimeout := time.Duration(cfg.ShutdownTimeout)
+	slog.Info("shutting down", "signal", sig.String(), "timeout", shutdownTimeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		// Closing the connections cancels the requests' contexts and with them their queries
+		slog.Error("graceful shutdown timed out, closing open connections", "error", err)
+		server.Close()
+	}
+}
+
+// getCategories retrieves all distinct category names, listing names that differ only in case
+// once, in alphabetical order, or reverse alphabetical order when descending is set. A non-empty collation names the
+// database collation used for the comparison.
+func getCategories(ctx context.Context, db *sql.DB, descending bool, collation string) ([]Category, error) {
+	query := "SELECT \"name\" FROM (" + categoryNames + ") c ORDER BY \"name\""
+	if collation != "" {
+		query += " COLLATE " + pq.QuoteIdentifier(collation)
+	}
+	if descending {
+		query += " DESC"
+	}
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := make([]Category, 0)
+	for rows.Next() {
+		var category Category
+		if err := rows.Scan(&category.Name); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return categories, nil
+}
+
+// getCategoriesWithCounts returns the same categories as getCategories, each with the number
+// of products in it. Categories created ahead of stocking them have a count of 0.
+func getCategoriesWithCounts(ctx context.Context, db *sql.DB, descending bool, collation string) ([]CategoryWithCount, error) {
+	query := `
+		SELECT c."name", COALESCE(p."count", 0)
+		FROM (` + categoryNames + `) c
+		LEFT JOIN (` + categoryCounts + `) p ON p."key" = c."key"
+		ORDER BY c."name"`
+	if collation != "" {
+		query += " COLLATE " + pq.QuoteIdentifier(collation)
+	}
+	if descending {
+		query += " DESC"
+	}
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := make([]CategoryWithCount, 0)
+	for rows.Next() {
+		var category CategoryWithCount
+		if err := rows.Scan(&category.Name, &category.Count); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return categories, nil
+}
+
+// productColumns is the column list scanned by scanProducts, prefixed with the Products table alias "p".
+const productColumns = "p.\"asin\", p.\"title\", p.\"imgUrl\", p.\"productUrl\", p.\"stars\", p.\"reviews\", p.\"price\", p.\"isBestSeller\", p.\"boughtInLastMonth\", p.\"categoryName\""
+
+// scanDest returns the scan destinations for the columns in productColumns.
+func (product *Product) scanDest() []interface{} {
+	return []interface{}{&product.ASIN, &product.Title, &product.ImgURL, &product.ProductURL, &product.Stars, &product.Reviews, &product.Price, &product.IsBestSeller, &product.BoughtInLastMonth, &product.CategoryName}
+}
+
+// stockColumn and stockJoin add the available unit count to a product query. Products
+// without a ProductCounts row are reported as having 0 units.
+const (
+	stockColumn = "COALESCE(pc.\"count\", 0)"
+	stockJoin   = " LEFT JOIN \"ProductCounts\" pc ON pc.\"asin\" = p.\"asin\""
+)
+
+// scanProducts reads all rows selected with productColumns into a slice of products.
+// When withStock is set each row must also select stockColumn after the product columns.
+// The slice is never nil so that an empty result encodes as [] rather than null.
+func scanProducts(rows *sql.Rows, withStock bool) ([]Product, error) {
+	products := make([]Product, 0)
+	for rows.Next() {
+		var product Product
+		dest := product.scanDest()
+		if withStock {
+			product.Available = new(int)
+			dest = append(dest, product.Available)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return products, nil
+}
+
+// productSorts maps the accepted ?sort= values of product listings to their ORDER BY
+// clauses. User input is only ever used as a key into this map, never put in the SQL.
+var productSorts = map[string]string{
+	"":             `p."asin"`,
+	"price_asc":    `p."price" ASC, p."asin"`,
+	"price_desc":   `p."price" DESC, p."asin"`,
+	"stars_asc":    `p."stars" ASC, p."asin"`,
+	"stars_desc":   `p."stars" DESC, p."asin"`,
+	"reviews_asc":  `p."reviews" ASC, p."asin"`,
+	"reviews_desc": `p."reviews" DESC, p."asin"`,
+}
+
+// defaultSortOrders is the direction of each ?sort= field when ?order= is absent.
+var defaultSortOrders = map[string]string{
+	"price":   "asc",
+	"stars":   "desc",
+	"reviews": "desc",
+}
+
+// parseProductSort returns the productSorts key requested either as ?sort=price_asc or as
+// ?sort=price&order=asc, with order defaulting per field as in defaultSortOrders.
+func parseProductSort(r *http.Request) (string, error) {
+	sort := r.URL.Query().Get("sort")
+	order := r.URL.Query().Get("order")
+
+	if def, ok := defaultSortOrders[sort]; ok {
+		if order == "" {
+			order = def
+		}
+		if order != "asc" && order != "desc" {
+			return "", ErrInvalidSort
+		}
+		return sort + "_" + order, nil
+	}
+
+	if _, ok := productSorts[sort]; !ok || order != "" {
+		return "", ErrInvalidSort
+	}
+	return sort, nil
+}
+
+// getProductsByCategory retrieves a page of the products from the Products table for a given
+// category that match filter, ordered by one of productSorts, along with the total number of
+// matches. When withStock is set each product also carries its available unit count. It
+// returns ErrCategoryNotFound when the category doesn't exist at all.
+//
+// With the default order by ASIN, after is a keyset cursor: only products with a greater ASIN
+// are listed, which stays fast however deep the page is, and the page carries the cursor of
+// the next page. Total always counts every match.
+func getProductsByCategory(ctx context.Context, db *sql.DB, category string, filter ProductFilter, sort string, withStock bool, limit, offset int, after string) (ProductPage, error) {
+	orderBy, ok := productSorts[sort]
+	if !ok {
+		return ProductPage{}, ErrInvalidSort
+	}
+
+	var where whereBuilder
+	where.add("lower(p.\"categoryName\") = lower(?)", category)
+	filter.apply(&where)
+
+	page := ProductPage{Limit: limit, Offset: offset}
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM \"Products\" p"+where.clause(), where.args...).Scan(&page.Total); err != nil {
+		return ProductPage{}, err
+	}
+
+	// Tell an unknown category apart from one that has no matching products
+	if page.Total == 0 {
+		exists, err := categoryExists(ctx, db, category)
+		if err != nil {
+			return ProductPage{}, err
+		}
+		if !exists {
+			return ProductPage{}, ErrCategoryNotFound
+		}
+	}
+
+	query := "SELECT " + productColumns
+	if withStock {
+		query += ", " + stockColumn
+	}
+	query += " FROM \"Products\" p"
+	if withStock {
+		query += stockJoin
+	}
+	if after != "" {
+		where.add("p.\"asin\" > ?", after)
+	}
+	query += where.clause()
+
+	// Fetch one extra product to know whether there is a next page
+	keyset := sort == ""
+	fetch := limit
+	if keyset {
+		fetch++
+	}
+	query += " ORDER BY " + orderBy + " LIMIT " + where.bind(fetch) + " OFFSET " + where.bind(offset)
+
+	rows, err := db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return ProductPage{}, err
+	}
+	defer rows.Close()
+
+	page.Products, err = scanProducts(rows, withStock)
+	if err != nil {
+		return ProductPage{}, err
+	}
+
+	if keyset && len(page.Products) > limit {
+		page.Products = page.Products[:limit]
+		page.NextCursor = encodeCursor(page.Products[limit-1].ASIN)
+	}
+
+	return page, nil
+}
+
+// encodeCursor turns the last ASIN of a page into an opaque pagination cursor.
+func encodeCursor(asin string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(asin))
+}
+
+// parseCursor reads the "cursor" query parameter and returns the ASIN it encodes, or ""
+// when it is absent.
+func parseCursor(r *http.Request) (string, error) {
+	v := r.URL.Query().Get("cursor")
+	if v == "" {
+		return "", nil
+	}
+
+	asin, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil || len(asin) == 0 {
+		return "", ErrInvalidCursor
+	}
+
+	return string(asin), nil
+}
+
+// getProductsByCategories retrieves up to perCategory of the most bought products in each of
+// the given categories with a single query. The result has an entry for every requested
+// category, keyed by the name as requested, even when the category has no products.
+func getProductsByCategories(ctx context.Context, db *sql.DB, categories []string, perCategory int) (map[string][]Product, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+productColumns+`, p."requested"
+		FROM (
+			SELECT p.*, req."name" AS "requested",
+				ROW_NUMBER() OVER (PARTITION BY req."name" ORDER BY p."boughtInLastMonth" DESC, p."asin") AS "rank"
+			FROM "Products" p
+			JOIN unnest($1::text[]) AS req("name") ON lower(p."categoryName") = lower(req."name")
+		) p
+		WHERE p."rank" <= $2
+		ORDER BY p."requested", p."rank"`, pq.Array(categories), perCategory)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grouped := make(map[string][]Product, len(categories))
+	for _, category := range categories {
+		grouped[category] = make([]Product, 0)
+	}
+	for rows.Next() {
+		var product Product
+		var requested string
+		if err := rows.Scan(append(product.scanDest(), &requested)...); err != nil {
+			return nil, err
+		}
+		grouped[requested] = append(grouped[requested], product)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return grouped, nil
+}
+
+// getNewProducts retrieves a page of the products matching filter, most recently added first.
+// Soft-deleted products, those with a "deletedAt", are left out.
+func getNewProducts(ctx context.Context, db *sql.DB, filter ProductFilter, limit, offset int) (ProductPage, error) {
+	var where whereBuilder
+	where.add("p.\"deletedAt\" IS NULL")
+	filter.apply(&where)
+
+	page := ProductPage{Limit: limit, Offset: offset}
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM \"Products\" p"+where.clause(), where.args...).Scan(&page.Total); err != nil {
+		return ProductPage{}, err
+	}
+
+	query := "SELECT " + productColumns + " FROM \"Products\" p" + where.clause() +
+		" ORDER BY p.\"createdAt\" DESC, p.\"asin\" LIMIT " + where.bind(limit) + " OFFSET " + where.bind(offset)
+
+	rows, err := db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return ProductPage{}, err
+	}
+	defer rows.Close()
+
+	page.Products, err = scanProducts(rows, false)
+	if err != nil {
+		return ProductPage{}, err
+	}
+
+	return page, nil
+}
+
+// getProductsInCategories retrieves a page of the products in any of the given categories,
+// matched case-insensitively like getProductsByCategory. Unknown categories simply match
+// nothing.
+func getProductsInCategories(ctx context.Context, db *sql.DB, categories []string, filter ProductFilter, sort string, withStock bool, limit, offset int) (ProductPage, error) {
+	orderBy, ok := productSorts[sort]
+	if !ok {
+		return ProductPage{}, ErrInvalidSort
+	}
+
+	lowered := make([]string, len(categories))
+	for i, category := range categories {
+		lowered[i] = strings.ToLower(category)
+	}
+
+	var where whereBuilder
+	where.add("lower(p.\"categoryName\") = ANY(?)", pq.Array(lowered))
+	filter.apply(&where)
+
+	page := ProductPage{Limit: limit, Offset: offset}
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM \"Products\" p"+where.clause(), where.args...).Scan(&page.Total); err != nil {
+		return ProductPage{}, err
+	}
+
+	query := "SELECT " + productColumns
+	if withStock {
+		query += ", " + stockColumn
+	}
+	query += " FROM \"Products\" p"
+	if withStock {
+		query += stockJoin
+	}
+	query += where.clause() + " ORDER BY " + orderBy + " LIMIT " + where.bind(limit) + " OFFSET " + where.bind(offset)
+
+	rows, err := db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return ProductPage{}, err
+	}
+	defer rows.Close()
+
+	page.Products, err = scanProducts(rows, withStock)
+	if err != nil {
+		return ProductPage{}, err
+	}
+
+	return page, nil
+}
+
+// getDeterministicSample retrieves up to limit products from a stable subset holding roughly
+// fraction of the catalogue. Each product is placed in the subset by hashing seed and its ASIN
+// into 28 bits, so the same seed always selects, and orders, the same products.
+func getDeterministicSample(ctx context.Context, db *sql.DB, seed string, fraction float64, limit int) ([]Product, error) {
+	const bucketCount = 1 << 28
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+productColumns+`
+		FROM (
+			SELECT p.*, ('x' || substr(md5($1 || p."asin"), 1, 7))::bit(28)::int AS "bucket"
+			FROM "Products" p
+		) p
+		WHERE p."bucket" < $2
+		ORDER BY p."bucket", p."asin"
+		LIMIT $3`, seed, int64(fraction*bucketCount), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanProducts(rows, false)
+}
+
+// getBestSellers retrieves the best-seller products, most bought in the last month first.
+func getBestSellers(ctx context.Context, db *sql.DB, limit int) ([]Product, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+productColumns+" FROM \"Products\" p WHERE p.\"isBestSeller\" = true"+
+		" ORDER BY p.\"boughtInLastMonth\" DESC, p.\"asin\" LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanProducts(rows, false)
+}
+
+// getProductByASIN retrieves a single product. It returns sql.ErrNoRows when the product does not exist.
+func getProductByASIN(ctx context.Context, db *sql.DB, asin string) (*Product, error) {
+	var product Product
+	err := db.QueryRowContext(ctx, "SELECT "+productColumns+" FROM \"Products\" p WHERE p.\"asin\" = $1", asin).
+		Scan(product.scanDest()...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &product, nil
+}
+
+// getTopSpenders retrieves the users with the highest total spend over their orders, along
+// with their number of orders and the value of their largest order. Spend is taken from the
+// order totals recorded at checkout, so later price changes don't rewrite it; cancelled
+// orders are left out.
+func getTopSpenders(ctx context.Context, db *sql.DB, limit int) ([]UserSpend, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT "UserId", SUM("Total"), COUNT(*), MAX("Total")
+		FROM "Orders"
+		WHERE "Status" <> 'cancelled'
+		GROUP BY "UserId"
+		ORDER BY SUM("Total") DESC, "UserId"
+		LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	spenders := make([]UserSpend, 0)
+	for rows.Next() {
+		var spend UserSpend
+		if err := rows.Scan(&spend.UserID, &spend.TotalSpend, &spend.OrderCount, &spend.LargestOrder); err != nil {
+			return nil, err
+		}
+		spenders = append(spenders, spend)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return spenders, nil
+}
+
+// getLowStockProducts retrieves products that have at most threshold units left, lowest
+// stock first. Products that are already out of stock are only included with outOfStock.
+func getLowStockProducts(ctx context.Context, db *sql.DB, threshold int, outOfStock bool, limit int) ([]LowStockProduct, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+productColumns+`, pc."count"
+		FROM "Products" p
+		JOIN "ProductCounts" pc ON pc."asin" = p."asin"
+		WHERE (pc."count" > 0 OR $2) AND pc."count" <= $1
+		ORDER BY pc."count", p."asin"
+		LIMIT $3`, threshold, outOfStock, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := make([]LowStockProduct, 0)
+	for rows.Next() {
+		var product LowStockProduct
+		if err := rows.Scan(append(product.scanDest(), &product.Count)...); err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return products, nil
+}
+
+// maxViewsPerUser is how many product views are kept per user; older views are pruned.
+const maxViewsPerUser = 50
+
+// newViewRecorder returns a BatchWriter for ProductViews rows of (user_id, asin, viewed_at).
+// After each flush it prunes the oldest views of the users that were written.
+func newViewRecorder(db *sql.DB, batchSize int, interval time.Duration) *BatchWriter {
+	views := NewBatchWriter(db, "ProductViews", []string{"user_id", "asin", "viewed_at"}, batchSize, interval)
+	views.afterFlush = func(ctx context.Context, rows [][]interface{}) error {
+		users := make([]string, 0, len(rows))
+		for _, row := range rows {
+			users = append(users, row[0].(string))
+		}
+		return pruneViews(ctx, db, users)
+	}
+	return views
+}
+
+// pruneViews deletes all but the latest maxViewsPerUser views of each of the given users.
+func pruneViews(ctx context.Context, db *sql.DB, userIDs []string) error {
+	_, err := db.ExecContext(ctx, `
+		DELETE FROM "ProductViews" v
+		USING (
+			SELECT "id", ROW_NUMBER() OVER (PARTITION BY "user_id" ORDER BY "viewed_at" DESC, "id" DESC) AS "rn"
+			FROM "ProductViews"
+			WHERE "user_id" = ANY($1)
+		) ranked
+		WHERE v."id" = ranked."id" AND ranked."rn" > $2`, pq.Array(userIDs), maxViewsPerUser)
+	return err
+}
+
+// getRecentlyViewed retrieves the products a user viewed, most recent first, listing each product once.
+func getRecentlyViewed(ctx context.Context, db *sql.DB, userID string, limit int) ([]Product, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+productColumns+`
+		FROM (
+			SELECT "asin", MAX("viewed_at") AS "lastViewed"
+			FROM "ProductViews"
+			WHERE "user_id" = $1
+			GROUP BY "asin"
+		) v
+		JOIN "Products" p ON p."asin" = v."asin"
+		ORDER BY v."lastViewed" DESC
+		LIMIT $2`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanProducts(rows, false)
+}
+
+// getFrequentlyBoughtTogether retrieves the products that most often appear in the same
+// checked-out basket as the given product, ordered by how many baskets they share.
+func getFrequentlyBoughtTogether(ctx context.Context, db *sql.DB, asin string, limit int) ([]Product, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+productColumns+`
+		FROM (
+			SELECT other."ProductId", COUNT(DISTINCT other."BasketId") AS "together"
+			FROM "Baskets" seed
+			JOIN "Baskets" other ON other."BasketId" = seed."BasketId" AND other."ProductId" <> seed."ProductId"
+			WHERE seed."ProductId" = $1 AND seed."IsCheckedOut" = true AND other."IsCheckedOut" = true
+				AND seed."IsCancelled" = false AND other."IsCancelled" = false
+			GROUP BY other."ProductId"
+		) c
+		JOIN "Products" p ON p."asin" = c."ProductId"
+		ORDER BY c."together" DESC, p."asin"
+		LIMIT $2`, asin, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanProducts(rows, false)
+}
+
+// getBasket retrieves the user's rows of a basket with the items that have not been checked
+// out yet. A basket counts as checked out once all of its items are; an unknown basket is
+// returned empty.
+func getBasket(ctx context.Context, db *sql.DB, userID, basketID string) (Basket, error) {
+	basket := Basket{BasketID: basketID, UserID: userID, Items: make([]BasketLine, 0)}
+
+	var open, total int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FILTER (WHERE "IsCheckedOut" = false), COUNT(*)
+		FROM "Baskets"
+		WHERE "BasketId" = $1 AND "UserId" = $2`, basketID, userID).Scan(&open, &total)
+	if err != nil {
+		return Basket{}, err
+	}
+	basket.IsCheckedOut = total > 0 && open == 0
+
+	items, err := getBasketItems(ctx, db, userID, basketID)
+	if err != nil {
+		return Basket{}, err
+	}
+	for _, item := range items {
+		basket.addItem(item)
+	}
+
+	return basket, nil
+}
+
+// getUserBasket retrieves a basket like getBasket, but only if it belongs to userID. It
+// returns ErrBasketNotFound for an unknown basket or one of another user, so callers cannot
+// tell the two apart.
+func getUserBasket(ctx context.Context, db *sql.DB, userID, basketID string) (Basket, error) {
+	owner, err := getBasketOwner(ctx, db, basketID)
+	if err != nil {
+		return Basket{}, err
+	}
+	if owner != userID {
+		return Basket{}, ErrBasketNotFound
+	}
+	return getBasket(ctx, db, userID, basketID)
+}
+
+// getBasketItems retrieves the products in the user's basket that have not been checked out
+// yet, one line per product with the number of units in the basket.
+func getBasketItems(ctx context.Context, db *sql.DB, userID, basketID string) ([]BasketLine, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+productColumns+`, b."quantity"
+		FROM (
+			SELECT "ProductId", SUM("Quantity") AS "quantity"
+			FROM "Baskets"
+			WHERE "BasketId" = $1 AND "UserId" = $2 AND "IsCheckedOut" = false
+			GROUP BY "ProductId"
+		) b
+		JOIN "Products" p ON p."asin" = b."ProductId"
+		ORDER BY p."asin"`, basketID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]BasketLine, 0)
+	for rows.Next() {
+		var item BasketLine
+		if err := rows.Scan(append(item.scanDest(), &item.Quantity)...); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// addItemToBasket adds quantity units of a product to the basket and takes them out of the
+// ProductCounts table in the same transaction. It returns the basket's new version; see
+// bumpBasketVersion for expectedVersion.
+func addItemToBasket(ctx context.Context, db *sql.DB, productID, userID, basketID string, quantity int, expectedVersion *int64) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	version, err := bumpBasketVersion(ctx, tx, basketID, userID, expectedVersion)
+	if err != nil {
+		return 0, err
+	}
+
+	// Check if the product exists and has sufficient count, locking the row until the
+	// transaction ends so concurrent requests can't both take the last units
+	var count int
+	err = tx.QueryRowContext(ctx, "SELECT \"count\" FROM \"ProductCounts\" WHERE \"asin\" = $1 FOR UPDATE", productID).Scan(&count)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrProductNotFound
+		}
+		return 0, err
+	}
+
+	if count < quantity {
+		return 0, &StockError{ASIN: productID, Requested: quantity, Available: max(count, 0)}
+	}
+
+	if err = upsertBasketItem(ctx, tx, basketID, productID, userID, quantity); err != nil {
+		return 0, err
+	}
+
+	if err = takeStock(ctx, tx, productID, quantity, count); err != nil {
+		return 0, err
+	}
+
+	return version, tx.Commit()
+}
+
+// takeStock decrements a product's count by quantity as part of tx. The decrement and the
+// stock check are one statement, so the count can never go negative even if the caller's
+// earlier check is stale; a *StockError reporting available units is returned instead.
+func takeStock(ctx context.Context, tx *sql.Tx, asin string, quantity, available int) error {
+	result, err := tx.ExecContext(ctx, "UPDATE \"ProductCounts\" SET \"count\" = \"count\" - $2 WHERE \"asin\" = $1 AND \"count\" >= $2", asin, quantity)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return &StockError{ASIN: asin, Requested: quantity, Available: max(available, 0)}
+	}
+	return nil
+}
+
+// upsertBasketItem adds quantity units of a product to the open basket as part of tx, adding
+// to the product's row when the basket already holds it.
+func upsertBasketItem(ctx context.Context, tx *sql.Tx, basketID, productID, userID string, quantity int) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO "Baskets" ("BasketId", "ProductId", "UserId", "IsCheckedOut", "Quantity")
+		VALUES ($1, $2, $3, false, $4)
+		ON CONFLICT ("BasketId", "ProductId", "UserId") WHERE "IsCheckedOut" = false
+		DO UPDATE SET "Quantity" = "Baskets"."Quantity" + EXCLUDED."Quantity"`,
+		basketID, productID, userID, quantity)
+	return err
+}
+
+// setBasketItemQuantity changes the number of units of a product in the user's open basket to
+// quantity, taking the extra units out of stock or putting the removed ones back in the same
+// transaction. A quantity of 0 removes the product from the basket. It returns
+// ErrItemNotInBasket when the basket doesn't hold the product, and the basket's new version
+// otherwise; see bumpBasketVersion for expectedVersion.
+func setBasketItemQuantity(ctx context.Context, db *sql.DB, userID, basketID, productID string, quantity int, expectedVersion *int64) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	version, err := bumpBasketVersion(ctx, tx, basketID, userID, expectedVersion)
+	if err != nil {
+		return 0, err
+	}
+
+	var current int
+	err = tx.QueryRowContext(ctx, `
+		SELECT "Quantity" FROM "Baskets"
+		WHERE "BasketId" = $1 AND "ProductId" = $2 AND "UserId" = $3 AND "IsCheckedOut" = false
+		FOR UPDATE`, basketID, productID, userID).Scan(&current)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrItemNotInBasket
+		}
+		return 0, err
+	}
+
+	if quantity == 0 {
+		_, err = tx.ExecContext(ctx, `
+			DELETE FROM "Baskets"
+			WHERE "BasketId" = $1 AND "ProductId" = $2 AND "UserId" = $3 AND "IsCheckedOut" = false`, basketID, productID, userID)
+	} else {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE "Baskets" SET "Quantity" = $4
+			WHERE "BasketId" = $1 AND "ProductId" = $2 AND "UserId" = $3 AND "IsCheckedOut" = false`, basketID, productID, userID, quantity)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case quantity < current:
+		// Put the removed units back in stock
+
+		_, err = tx.ExecContext(ctx, "UPDATE \"ProductCounts\" SET \"count\" = \"count\" + $2 WHERE \"asin\" = $1", productID, current-quantity)
+		if err != nil {
+			return 0, err
+		}
+	case quantity > current:
+		extra := quantity - current
+
+		// Lock the stock row like addItemToBasket so concurrent requests can't both take the last units
+		var count int
+		err = tx.QueryRowContext(ctx, "SELECT \"count\" FROM \"ProductCounts\" WHERE \"asin\" = $1 FOR UPDATE", productID).Scan(&count)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return 0, ErrProductNotFound
+			}
+			return 0, err
+		}
+		if count < extra {
+			return 0, &StockError{ASIN: productID, Requested: extra, Available: max(count, 0)}
+		}
+
+		if err = takeStock(ctx, tx, productID, extra, count); err != nil {
+			return 0, err
+		}
+	}
+
+	return version, tx.Commit()
 }
 
-func main() {
-	// Database connection string
-	connStr := os.Getenv("DATABASE_URL")
-	db, err := sql.Open("postgres", connStr)
+// removeItemFromBasket removes one unit of a product from the basket and puts it back in
+// stock in the same transaction. It returns the basket's new version; see bumpBasketVersion
+// for expectedVersion.
+func removeItemFromBasket(ctx context.Context, db *sql.DB, productID, userID, basketID string, expectedVersion *int64) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	defer db.Close()
+	defer tx.Rollback()
 
-	// Test the database connection
-	err = db.Ping()
+	version, err := bumpBasketVersion(ctx, tx, basketID, userID, expectedVersion)
 	if err != nil {
-		log.Fatal("Cannot connect to the database:", err)
+		return 0, err
 	}
 
-	r := mux.NewRouter()
+	// Take one unit off the product's row, deleting the row when it held the last unit
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM "Baskets"
+		WHERE "BasketId" = $1 AND "ProductId" = $2 AND "UserId" = $3 AND "IsCheckedOut" = false AND "Quantity" = 1`,
+		basketID, productID, userID)
+	if err != nil {
+		return 0, err
+	}
 
-	// Define the route to get all categories
-	r.HandleFunc("/categories", func(w http.ResponseWriter, r *http.Request) {
-		categories, err := getCategories(db)
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if removed == 0 {
+		result, err = tx.ExecContext(ctx, `
+			UPDATE "Baskets" SET "Quantity" = "Quantity" - 1
+			WHERE "BasketId" = $1 AND "ProductId" = $2 AND "UserId" = $3 AND "IsCheckedOut" = false`,
+			basketID, productID, userID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return 0, err
 		}
+		if removed, err = result.RowsAffected(); err != nil {
+			return 0, err
+		}
+	}
+	if removed == 0 {
+		return 0, ErrItemNotInBasket
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(categories)
-	}).Methods("GET")
+	// Restore the product count
+	_, err = tx.ExecContext(ctx, "UPDATE \"ProductCounts\" SET \"count\" = \"count\" + 1 WHERE \"asin\" = $1", productID)
+	if err != nil {
+		return 0, err
+	}
 
-	// Define the route to get products by category
-	r.HandleFunc("/categories/{category}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		category := vars["category"]
+	return version, tx.Commit()
+}
+
+// clearBasket removes every unit from the user's open basket and puts them back in stock in
+// the same transaction. It returns how many units were removed and the basket's new version;
+// see bumpBasketVersion for expectedVersion.
+func clearBasket(ctx context.Context, db *sql.DB, userID, basketID string, expectedVersion *int64) (int, int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	version, err := bumpBasketVersion(ctx, tx, basketID, userID, expectedVersion)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM "Baskets"
+		WHERE "BasketId" = $1 AND "UserId" = $2 AND "IsCheckedOut" = false
+		RETURNING "ProductId", "Quantity"`, basketID, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removed := 0
+	quantities := make(map[string]int)
+	for rows.Next() {
+		var asin string
+		var quantity int
+		if err := rows.Scan(&asin, &quantity); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		quantities[asin] += quantity
+		removed += quantity
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
 
-		products, err := getProductsByCategory(db, category)
+	for asin, quantity := range quantities {
+		_, err = tx.ExecContext(ctx, "UPDATE \"ProductCounts\" SET \"count\" = \"count\" + $2 WHERE \"asin\" = $1", asin, quantity)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return 0, 0, err
 		}
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(products)
-	}).Methods("GET")
+	return removed, version, tx.Commit()
+}
 
-	// Define the route to add an item to the basket
-	r.HandleFunc("/add-item-to-basket", func(w http.ResponseWriter, r *http.Request) {
-		var req AddItemToBasketRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
-			return
+// transferBasket moves the open items of fromUserID's basket to toUserID in one transaction.
+// It returns how many units were moved and the basket's new version; see bumpBasketVersion
+// for expectedVersion.
+func transferBasket(ctx context.Context, db *sql.DB, basketID, fromUserID, toUserID string, expectedVersion *int64) (int, int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	version, err := bumpBasketVersion(ctx, tx, basketID, fromUserID, expectedVersion)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var open, checkedOut int
+	err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM("Quantity") FILTER (WHERE NOT "IsCheckedOut"), 0), COUNT(*) FILTER (WHERE "IsCheckedOut")
+		FROM "Baskets"
+		WHERE "UserId" = $1 AND "BasketId" = $2`, fromUserID, basketID).Scan(&open, &checkedOut)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch {
+	case open == 0 && checkedOut > 0:
+		return 0, 0, ErrAlreadyCheckedOut
+	case open == 0:
+		return 0, 0, ErrEmptyBasket
+	}
+
+	// Products the target user already has in the basket are merged into their rows
+	_, err = tx.ExecContext(ctx, `
+		UPDATE "Baskets" t SET "Quantity" = t."Quantity" + f."Quantity"
+		FROM "Baskets" f
+		WHERE f."UserId" = $1 AND f."BasketId" = $2 AND f."IsCheckedOut" = false
+			AND t."UserId" = $3 AND t."BasketId" = $2 AND t."IsCheckedOut" = false AND t."ProductId" = f."ProductId"`,
+		fromUserID, basketID, toUserID)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM "Baskets" f
+		WHERE f."UserId" = $1 AND f."BasketId" = $2 AND f."IsCheckedOut" = false
+			AND EXISTS (
+				SELECT 1 FROM "Baskets" t
+				WHERE t."UserId" = $3 AND t."BasketId" = $2 AND t."IsCheckedOut" = false AND t."ProductId" = f."ProductId"
+			)`, fromUserID, basketID, toUserID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE "Baskets" SET "UserId" = $3
+		WHERE "UserId" = $1 AND "BasketId" = $2 AND "IsCheckedOut" = false`, fromUserID, basketID, toUserID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = setBasketOwner(ctx, tx, basketID, toUserID); err != nil {
+		return 0, 0, err
+	}
+
+	return open, version, tx.Commit()
+}
+
+// reserveMultiple adds all items to the basket and takes them out of stock in one transaction.
+// If any product is missing or short on stock nothing is reserved and a *BundleError lists
+// every offending item. It returns the basket's new version; see bumpBasketVersion for
+// expectedVersion.
+func reserveMultiple(ctx context.Context, db *sql.DB, userID, basketID string, items []BasketItem, expectedVersion *int64) (int64, error) {
+	// The same product may be listed more than once
+	requested := make(map[string]int)
+	asins := make([]string, 0, len(items))
+	for _, item := range items {
+		if _, ok := requested[item.ProductID]; !ok {
+			asins = append(asins, item.ProductID)
 		}
+		requested[item.ProductID] += item.Quantity
+	}
 
-		err := addItemToBasket(db, req.ProductID, req.UserID, req.BasketID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	version, err := bumpBasketVersion(ctx, tx, basketID, userID, expectedVersion)
+	if err != nil {
+		return 0, err
+	}
+
+	// Lock the stock rows in a fixed order so concurrent bundles can't deadlock
+	rows, err := tx.QueryContext(ctx, "SELECT \"asin\", \"count\" FROM \"ProductCounts\" WHERE \"asin\" = ANY($1) ORDER BY \"asin\" FOR UPDATE", pq.Array(asins))
+	if err != nil {
+		return 0, err
+	}
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var asin string
+		var count int
+		if err := rows.Scan(&asin, &count); err != nil {
+			rows.Close()
+			return 0, err
 		}
+		counts[asin] = count
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
 
-		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte("Item added to basket"))
-	}).Methods("POST")
+	bundleErr := &BundleError{Shortages: make([]StockError, 0), Missing: make([]string, 0)}
+	for _, asin := range asins {
+		count, ok := counts[asin]
+		if !ok {
+			bundleErr.Missing = append(bundleErr.Missing, asin)
+		} else if count < requested[asin] {
+			bundleErr.Shortages = append(bundleErr.Shortages, StockError{ASIN: asin, Requested: requested[asin], Available: max(count, 0)})
+		}
+	}
+	if len(bundleErr.Shortages) > 0 || len(bundleErr.Missing) > 0 {
+		return 0, bundleErr
+	}
 
-	// Define the route to checkout a basket
-	r.HandleFunc("/checkout-basket", func(w http.ResponseWriter, r *http.Request) {
-		var req CheckoutBasketRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
-			return
+	for _, asin := range asins {
+		if err = upsertBasketItem(ctx, tx, basketID, asin, userID, requested[asin]); err != nil {
+			return 0, err
 		}
 
-		err := checkoutBasket(db, req.UserID, req.BasketID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		if err = takeStock(ctx, tx, asin, requested[asin], counts[asin]); err != nil {
+			var stockErr *StockError
+			if errors.As(err, &stockErr) {
+				return 0, &BundleError{Shortages: []StockError{*stockErr}, Missing: make([]string, 0)}
+			}
+			return 0, err
 		}
+	}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Basket checked out successfully"))
-	}).Methods("POST")
+	return version, tx.Commit()
+}
+
+// basketItemResults reports the outcome of reserveMultiple for each of items. bundleErr is
+// the error reserveMultiple returned, or nil when every item was added.
+func basketItemResults(items []BasketItem, bundleErr *BundleError) []BasketItemResult {
+	shortages := make(map[string]int)
+	missing := make(map[string]bool)
+	if bundleErr != nil {
+		for _, shortage := range bundleErr.Shortages {
+			shortages[shortage.ASIN] = shortage.Available
+		}
+		for _, asin := range bundleErr.Missing {
+			missing[asin] = true
+		}
+	}
 
-	fmt.Println("Server is running on port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", r))
+	results := make([]BasketItemResult, 0, len(items))
+	for _, item := range items {
+		result := BasketItemResult{ProductID: item.ProductID, Quantity: item.Quantity, Status: "added"}
+		if available, ok := shortages[item.ProductID]; ok {
+			result.Status = "out_of_stock"
+			result.Available = &available
+		} else if missing[item.ProductID] {
+			result.Status = "not_found"
+		} else if bundleErr != nil {
+			result.Status = "rolled_back"
+		}
+		results = append(results, result)
+	}
+	return results
 }
 
-// getCategories retrieves all distinct category names from the Products table.
-func getCategories(db *sql.DB) ([]Category, error) {
-	rows, err := db.Query("SELECT DISTINCT \"categoryName\" FROM \"Products\"")
+// checkoutBasket checks out the basket and marks all items as checked out. The user's items
+// in the basket are locked and re-verified first: it returns ErrEmptyBasket when there is
+// nothing to check out, ErrAlreadyCheckedOut when every item already was, and an error
+// matching ErrProductNotFound when an item's product no longer exists.
+// When idempotencyKey is set it is claimed first, and errReplayed is returned if the user
+// already used it within keyTTL.
+// The items are recorded as a new order with their current prices, see createOrder, and the
+// result carries the order and the basket's new version; see bumpBasketVersion for
+// expectedVersion.
+func checkoutBasket(ctx context.Context, db *sql.DB, userID, basketID string, expectedVersion *int64, idempotencyKey string, keyTTL time.Duration) (*CheckoutResult, error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	var categories []Category
-	for rows.Next() {
-		var category Category
-		if err := rows.Scan(&category.Name); err != nil {
+	if idempotencyKey != "" {
+		if err := claimIdempotencyKey(ctx, tx, userID, idempotencyKey, basketID, keyTTL); err != nil {
 			return nil, err
 		}
-		categories = append(categories, category)
 	}
 
+	version, err := bumpBasketVersion(ctx, tx, basketID, userID, expectedVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT b."ProductId", b."IsCheckedOut", EXISTS (SELECT 1 FROM "Products" p WHERE p."asin" = b."ProductId")
+		FROM "Baskets" b
+		WHERE b."UserId" = $1 AND b."BasketId" = $2
+		FOR UPDATE OF b`, userID, basketID)
+	if err != nil {
+		return nil, err
+	}
+
+	var open, checkedOut int
+	missing := make([]string, 0)
+	for rows.Next() {
+		var asin string
+		var isCheckedOut, exists bool
+		if err := rows.Scan(&asin, &isCheckedOut, &exists); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if isCheckedOut {
+			checkedOut++
+			continue
+		}
+		open++
+		if !exists {
+			missing = append(missing, asin)
+		}
+	}
+	rows.Close()
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return categories, nil
-}
+	switch {
+	case open == 0 && checkedOut > 0:
+		return nil, ErrAlreadyCheckedOut
+	case open == 0:
+		return nil, ErrEmptyBasket
+	case len(missing) > 0:
+		return nil, fmt.Errorf("%w: %s", ErrProductNotFound, strings.Join(missing, ", "))
+	}
 
-// getProductsByCategory retrieves all products from the Products table for a given category.
-func getProductsByCategory(db *sql.DB, category string) ([]Product, error) {
-	rows, err := db.Query("SELECT \"asin\", \"title\", \"imgUrl\", \"productUrl\", \"stars\", \"reviews\", \"price\", \"isBestSeller\", \"boughtInLastMonth\", \"categoryName\" FROM \"Products\" WHERE \"categoryName\" = $1", category)
+	orderID, total, err := createOrder(ctx, tx, userID, basketID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var products []Product
-	for rows.Next() {
-		var product Product
-		if err := rows.Scan(&product.ASIN, &product.Title, &product.ImgURL, &product.ProductURL, &product.Stars, &product.Reviews, &product.Price, &product.IsBestSeller, &product.BoughtInLastMonth, &product.CategoryName); err != nil {
+	result, err := tx.ExecContext(ctx, "UPDATE \"Baskets\" SET \"IsCheckedOut\" = true, \"CheckedOutAt\" = now() WHERE \"UserId\" = $1 AND \"BasketId\" = $2 AND \"IsCheckedOut\" = false", userID, basketID)
+	if err != nil {
+		return nil, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if int(affected) != open {
+		return nil, fmt.Errorf("checked out %d of %d basket items", affected, open)
+	}
+
+	if idempotencyKey != "" {
+		if err := completeIdempotencyKey(ctx, tx, userID, idempotencyKey, version, orderID); err != nil {
 			return nil, err
 		}
-		products = append(products, product)
 	}
 
-	if err = rows.Err(); err != nil {
+	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
+	return &CheckoutResult{OrderID: orderID, BasketID: basketID, Total: total, Version: version}, nil
+}
 
-	return products, nil
+// getBasketWeight sums the weight of the items in the user's basket that have not been checked
+// out yet. Items whose product has no weight recorded count as 0 and are reported in
+// ItemsMissingWeight.
+func getBasketWeight(ctx context.Context, db *sql.DB, userID, basketID string) (BasketWeight, error) {
+	weight := BasketWeight{BasketID: basketID}
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(COALESCE(p."weight", 0) * b."Quantity"), 0), COALESCE(SUM(b."Quantity") FILTER (WHERE p."weight" IS NULL), 0)
+		FROM "Baskets" b
+		JOIN "Products" p ON p."asin" = b."ProductId"
+		WHERE b."BasketId" = $1 AND b."UserId" = $2 AND b."IsCheckedOut" = false`, basketID, userID).Scan(&weight.Weight, &weight.ItemsMissingWeight)
+	if err != nil {
+		return BasketWeight{}, err
+	}
+
+	return weight, nil
 }
 
-// addItemToBasket adds an item to the basket and updates the ProductCounts table
-func addItemToBasket(db *sql.DB, productID, userID, basketID string) error {
-	tx, err := db.Begin()
+// cancelOrder cancels the user's checked-out basket if it was checked out less than window ago,
+// and returns its items to stock. The basket rows are kept and marked as cancelled.
+func cancelOrder(ctx context.Context, db *sql.DB, userID, basketID string, window time.Duration) error {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	// Check if the product exists and has sufficient count
-	var count int
-	err = tx.QueryRow("SELECT \"count\" FROM \"ProductCounts\" WHERE \"asin\" = $1", productID).Scan(&count)
+	rows, err := tx.QueryContext(ctx, `
+		SELECT "ProductId", "Quantity", "IsCheckedOut", "IsCancelled", "CheckedOutAt"
+		FROM "Baskets"
+		WHERE "UserId" = $1 AND "BasketId" = $2
+		FOR UPDATE`, userID, basketID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return fmt.Errorf("product not found")
+		return err
+	}
+
+	var found, cancelled bool
+	var checkedOutAt sql.NullTime
+	quantities := make(map[string]int)
+	for rows.Next() {
+		var asin string
+		var quantity int
+		var isCheckedOut, isCancelled bool
+		var at sql.NullTime
+		if err := rows.Scan(&asin, &quantity, &isCheckedOut, &isCancelled, &at); err != nil {
+			rows.Close()
+			return err
 		}
+		found = true
+		if !isCheckedOut {
+			continue
+		}
+		if isCancelled {
+			cancelled = true
+			continue
+		}
+		quantities[asin] += quantity
+		if at.Valid && (!checkedOutAt.Valid || at.Time.Before(checkedOutAt.Time)) {
+			checkedOutAt = at
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
 		return err
 	}
 
-	if count <= 0 {
-		return fmt.Errorf("product out of stock")
+	switch {
+	case !found:
+		return ErrOrderNotFound
+	case len(quantities) == 0 && cancelled:
+		return ErrAlreadyCancelled
+	case len(quantities) == 0:
+		return ErrNotCheckedOut
+	case !checkedOutAt.Valid || time.Since(checkedOutAt.Time) > window:
+		// Orders checked out before CheckedOutAt was recorded are always outside the window
+		return ErrCancellationWindowPassed
 	}
 
-	// Insert the product into the Baskets table
-	_, err = tx.Exec("INSERT INTO \"Baskets\" (\"BasketId\", \"ProductId\", \"UserId\", \"IsCheckedOut\") VALUES ($1, $2, $3, $4)",
-		basketID, productID, userID, false)
-	if err != nil {
+	// The rows were matched by user above; the basket itself may have been transferred since
+	if _, err = bumpBasketVersion(ctx, tx, basketID, "", nil); err != nil {
 		return err
 	}
 
-	// Decrement the product count
-	_, err = tx.Exec("UPDATE \"ProductCounts\" SET \"count\" = \"count\" - 1 WHERE \"asin\" = $1", productID)
+	_, err = tx.ExecContext(ctx, `
+		UPDATE "Baskets" SET "IsCancelled" = true
+		WHERE "UserId" = $1 AND "BasketId" = $2 AND "IsCheckedOut" = true AND "IsCancelled" = false`, userID, basketID)
 	if err != nil {
 		return err
 	}
+	if err = cancelOrders(ctx, tx, userID, basketID); err != nil {
+		return err
+	}
+
+	for asin, quantity := range quantities {
+		var count int
+		err = tx.QueryRowContext(ctx, "UPDATE \"ProductCounts\" SET \"count\" = \"count\" + $2 WHERE \"asin\" = $1 RETURNING \"count\"", asin, quantity).Scan(&count)
+		if err == sql.ErrNoRows {
+			// The product has been removed from inventory since; there is nothing to restock
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = recordStockChange(ctx, tx, asin, quantity, count, "order cancelled"); err != nil {
+			return err
+		}
+	}
 
 	return tx.Commit()
 }
 
-// checkoutBasket checks out the basket and marks all items as checked out
-func checkoutBasket(db *sql.DB, userID, basketID string) error {
-	_, err := db.Exec("UPDATE \"Baskets\" SET \"IsCheckedOut\" = true WHERE \"UserId\" = $1 AND \"BasketId\" = $2", userID, basketID)
+// canCheckout runs the pre-checkout checks on the user's basket. The basket can be checked out
+// when it has items that are not checked out yet and every one of them is still a product with
+// a ProductCounts row that has not been oversold.
+func canCheckout(ctx context.Context, db *sql.DB, userID, basketID string) (CheckoutReadiness, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT b."ProductId", b."IsCheckedOut", p."asin" IS NOT NULL AND pc."count" >= 0
+		FROM "Baskets" b
+		LEFT JOIN "Products" p ON p."asin" = b."ProductId"
+		LEFT JOIN "ProductCounts" pc ON pc."asin" = b."ProductId"
+		WHERE b."BasketId" = $1 AND b."UserId" = $2`, basketID, userID)
+	if err != nil {
+		return CheckoutReadiness{}, err
+	}
+	defer rows.Close()
+
+	var open, checkedOut int
+	unavailable := make([]string, 0)
+	for rows.Next() {
+		var asin string
+		var isCheckedOut bool
+		var available sql.NullBool
+		if err := rows.Scan(&asin, &isCheckedOut, &available); err != nil {
+			return CheckoutReadiness{}, err
+		}
+		if isCheckedOut {
+			checkedOut++
+			continue
+		}
+		open++
+		if !available.Bool {
+			unavailable = append(unavailable, asin)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return CheckoutReadiness{}, err
+	}
+
+	readiness := CheckoutReadiness{BasketID: basketID, Reasons: make([]BlockingReason, 0)}
+	switch {
+	case open == 0 && checkedOut > 0:
+		readiness.Reasons = append(readiness.Reasons, BlockingReason{Code: "already_checked_out"})
+	case open == 0:
+		readiness.Reasons = append(readiness.Reasons, BlockingReason{Code: "empty"})
+	}
+	if len(unavailable) > 0 {
+		readiness.Reasons = append(readiness.Reasons, BlockingReason{Code: "out_of_stock", ASINs: unavailable})
+	}
+	readiness.CanCheckout = len(readiness.Reasons) == 0
+
+	return readiness, nil
+}
+
+// recordStockChange appends an entry to the StockHistory table as part of tx.
+func recordStockChange(ctx context.Context, tx *sql.Tx, asin string, delta, count int, reason string) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO \"StockHistory\" (\"asin\", \"delta\", \"count\", \"reason\") VALUES ($1, $2, $3, $4)",
+		asin, delta, count, reason)
 	return err
 }
 
-// GenerateRandomUserID generates a random UserID for each session (for example usage)
+// setCategoryStockZero marks every product in the category as out of stock and returns
+// the number of products whose count was changed.
+func setCategoryStockZero(ctx context.Context, db *sql.DB, category string) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the affected rows so concurrent basket updates wait for the reset
+	rows, err := tx.QueryContext(ctx, `
+		SELECT pc."asin", pc."count"
+		FROM "ProductCounts" pc
+		JOIN "Products" p ON p."asin" = pc."asin"
+		WHERE lower(p."categoryName") = lower($1) AND pc."count" <> 0
+		FOR UPDATE OF pc`, category)
+	if err != nil {
+		return 0, err
+	}
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var asin string
+		var count int
+		if err := rows.Scan(&asin, &count); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		counts[asin] = count
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for asin, count := range counts {
+		_, err = tx.ExecContext(ctx, "UPDATE \"ProductCounts\" SET \"count\" = 0 WHERE \"asin\" = $1", asin)
+		if err != nil {
+			return 0, err
+		}
+		if err = recordStockChange(ctx, tx, asin, -count, 0, "category zero-stock"); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(counts), nil
+}
+
+// parseLimit reads the "limit" query parameter, returning def when it is absent and
+// clamping it to max.
+func parseLimit(r *http.Request, def, max int) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return def, nil
+	}
+
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit <= 0 {
+		return 0, ErrInvalidLimit
+	}
+	if limit > max {
+		limit = max
+	}
+
+	return limit, nil
+}
+
+// parseThreshold reads the "threshold" query parameter, a non-negative stock count,
+// returning def when it is absent.
+func parseThreshold(r *http.Request, def int) (int, error) {
+	v := r.URL.Query().Get("threshold")
+	if v == "" {
+		return def, nil
+	}
+
+	threshold, err := strconv.Atoi(v)
+	if err != nil || threshold < 0 {
+		return 0, ErrInvalidThreshold
+	}
+
+	return threshold, nil
+}
+
+// parseOffset reads the "offset" query parameter, returning 0 when it is absent.
+func parseOffset(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("offset")
+	if v == "" {
+		return 0, nil
+	}
+
+	offset, err := strconv.Atoi(v)
+	if err != nil || offset < 0 {
+		return 0, ErrInvalidOffset
+	}
+
+	return offset, nil
+}
+
+// wantsInclude reports whether the comma-separated "include" query parameter lists name.
+func wantsInclude(r *http.Request, name string) bool {
+	for _, v := range strings.Split(r.URL.Query().Get("include"), ",") {
+		if strings.TrimSpace(v) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// reassignProducts moves the given products to newCategory. It returns the number of
+// products updated and the ASINs that did not match any product.
+func reassignProducts(ctx context.Context, db *sql.DB, asins []string, newCategory string) (int, []string, error) {
+	rows, err := db.QueryContext(ctx, "UPDATE \"Products\" SET \"categoryName\" = $1 WHERE \"asin\" = ANY($2) RETURNING \"asin\"",
+		newCategory, pq.Array(asins))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	updated := make(map[string]bool)
+	for rows.Next() {
+		var asin string
+		if err := rows.Scan(&asin); err != nil {
+			return 0, nil, err
+		}
+		updated[asin] = true
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	missing := make([]string, 0)
+	for _, asin := range asins {
+		if !updated[asin] {
+			missing = append(missing, asin)
+		}
+	}
+
+	return len(updated), missing, nil
+}
+
+// GenerateRandomUserID generates a random UserID for each session (for example usage).
+// The characters are drawn from crypto/rand, so IDs are unpredictable and safe to use as
+// session identifiers.
 func GenerateRandomUserID() string {
-	rand.Seed(time.Now().UnixNano())
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, 8)
-	for i := range b {
-		b[i] = charset[rand.Intn(len(charset))]
+	// Bytes at or above limit are discarded so every character is equally likely.
+	const limit = 256 - 256%len(charset)
+	b := make([]byte, 0, 8)
+	buf := make([]byte, 16)
+	for len(b) < cap(b) {
+		if _, err := rand.Read(buf); err != nil {
+			panic("crypto/rand: " + err.Error())
+		}
+		for _, c := range buf {
+			if int(c) < limit && len(b) < cap(b) {
+				b = append(b, charset[int(c)%len(charset)])
+			}
+		}
 	}
 	return string(b)
 }
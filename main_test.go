@@ -0,0 +1,920 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"50%", `50\%`},
+		{"a_b", `a\_b`},
+		{`c:\d`, `c:\\d`},
+		{`100%_\`, `100\%\_\\`},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := escapeLike(tt.in); got != tt.want {
+			t.Errorf("escapeLike(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeCategory(t *testing.T) {
+	tests := []struct {
+		in        string
+		titleCase bool
+		want      string
+	}{
+		{"Electronics", false, "Electronics"},
+		{"  electronics ", false, "electronics"},
+		{"TV   &\tvideo", false, "TV & video"},
+		{"   ", false, ""},
+		{"\t\n", false, ""},
+		{"", false, ""},
+		{"  tv & video ", true, "Tv & Video"},
+		{"TV & video", true, "TV & Video"},
+		{"électronique grand public", true, "Électronique Grand Public"},
+		{"   ", true, ""},
+	}
+	defer func(old bool) { titleCaseCategories = old }(titleCaseCategories)
+	for _, tt := range tests {
+		titleCaseCategories = tt.titleCase
+		if got := normalizeCategory(tt.in); got != tt.want {
+			t.Errorf("normalizeCategory(%q) with title case %v = %q, want %q", tt.in, tt.titleCase, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeCategories(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want []string
+	}{
+		{nil, []string{}},
+		{[]string{" Books ", "books", "BOOKS"}, []string{"Books"}},
+		{[]string{"", "  ", "TV  &  video", "Books"}, []string{"TV & video", "Books"}},
+	}
+	for _, tt := range tests {
+		if got := normalizeCategories(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("normalizeCategories(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestProductInputNormalizesCategory checks the write path: a product's category is stored
+// normalized, and one that is empty after trimming is rejected.
+func TestProductInputNormalizesCategory(t *testing.T) {
+	in := ProductInput{Product: Product{ASIN: "B000000001", Title: "Lamp", CategoryName: "  home   lighting "}}
+	if err := in.validate(true); err != nil {
+		t.Fatal(err)
+	}
+	if in.CategoryName != "home lighting" {
+		t.Errorf("CategoryName = %q, want %q", in.CategoryName, "home lighting")
+	}
+
+	in = ProductInput{Product: Product{ASIN: "B000000001", Title: "Lamp", CategoryName: " \t "}}
+	var validationErr *ValidationError
+	if err := in.validate(true); !errors.As(err, &validationErr) || validationErr.Fields["categoryName"] == "" {
+		t.Errorf("validate with a blank category = %v, want a categoryName error", err)
+	}
+}
+
+func TestParseProductSort(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string
+		wantErr error
+	}{
+		{"", "", nil},
+		{"sort=price", "price_asc", nil},
+		{"sort=stars", "stars_desc", nil},
+		{"sort=reviews", "reviews_desc", nil},
+		{"sort=price&order=desc", "price_desc", nil},
+		{"sort=stars&order=asc", "stars_asc", nil},
+		{"sort=price_desc", "price_desc", nil},
+		{"sort=price&order=up", "", ErrInvalidSort},
+		{"sort=price_desc&order=asc", "", ErrInvalidSort},
+		{"order=asc", "", ErrInvalidSort},
+		{"sort=title", "", ErrInvalidSort},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/products?"+tt.query, nil)
+		got, err := parseProductSort(r)
+		if got != tt.want || err != tt.wantErr {
+			t.Errorf("parseProductSort(%q) = %q, %v, want %q, %v", tt.query, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseIfMatch(t *testing.T) {
+	version := func(v int64) *int64 { return &v }
+	tests := []struct {
+		header  string
+		want    *int64
+		wantErr error
+	}{
+		{"", nil, nil},
+		{`"3"`, version(3), nil},
+		{`W/"3"`, version(3), nil},
+		{"0", version(0), nil},
+		{`"abc"`, nil, ErrInvalidIfMatch},
+		{`"-1"`, nil, ErrInvalidIfMatch},
+		{"*", nil, ErrInvalidIfMatch},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/add-item-to-basket", nil)
+		if tt.header != "" {
+			r.Header.Set("If-Match", tt.header)
+		}
+		got, err := parseIfMatch(r)
+		if !reflect.DeepEqual(got, tt.want) || err != tt.wantErr {
+			t.Errorf("parseIfMatch(%q) = %v, %v, want %v, %v", tt.header, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestBuildCategoryTree(t *testing.T) {
+	leaf := func(name string, count int) CategoryNode {
+		return CategoryNode{Name: name, ProductCount: count, TotalProductCount: count, Children: []CategoryNode{}}
+	}
+	tests := []struct {
+		name    string
+		parents map[string]string
+		counts  map[string]int
+		want    []CategoryNode
+	}{
+		{
+			name: "empty",
+			want: []CategoryNode{},
+		},
+		{
+			name:    "nested",
+			parents: map[string]string{"Electronics": "", "TV": "Electronics", "Audio": "Electronics", "Books": ""},
+			counts:  map[string]int{"Electronics": 1, "TV": 2, "Audio": 3, "Books": 4},
+			want: []CategoryNode{
+				leaf("Books", 4),
+				{Name: "Electronics", ProductCount: 1, TotalProductCount: 6, Children: []CategoryNode{leaf("Audio", 3), leaf("TV", 2)}},
+			},
+		},
+		{
+			name:    "unknown parent becomes a root",
+			parents: map[string]string{"TV": "Gone"},
+			counts:  map[string]int{"TV": 2},
+			want:    []CategoryNode{leaf("TV", 2)},
+		},
+		{
+			name:    "own parent becomes a root",
+			parents: map[string]string{"TV": "TV"},
+			want:    []CategoryNode{leaf("TV", 0)},
+		},
+		{
+			name:    "two-category cycle is broken at the first name",
+			parents: map[string]string{"A": "B", "B": "A"},
+			counts:  map[string]int{"A": 1, "B": 2},
+			want:    []CategoryNode{{Name: "A", ProductCount: 1, TotalProductCount: 3, Children: []CategoryNode{leaf("B", 2)}}},
+		},
+		{
+			name:    "three-category cycle next to a normal root",
+			parents: map[string]string{"Root": "", "X": "Z", "Y": "X", "Z": "Y"},
+			want: []CategoryNode{
+				leaf("Root", 0),
+				{Name: "X", Children: []CategoryNode{{Name: "Y", Children: []CategoryNode{leaf("Z", 0)}}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildCategoryTree(tt.parents, tt.counts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildCategoryTree() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterClientIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustForwarded bool
+		remoteAddr     string
+		forwardedFor   string
+		want           string
+	}{
+		{"remote address", false, "192.0.2.1:1234", "", "192.0.2.1"},
+		{"forwarded header ignored without a proxy", false, "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"last forwarded entry behind a proxy", true, "10.0.0.1:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"single forwarded entry", true, "10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"empty last forwarded entry", true, "10.0.0.1:1234", "198.51.100.7, ", "10.0.0.1"},
+		{"no forwarded header behind a proxy", true, "10.0.0.1:1234", "", "10.0.0.1"},
+		{"IPv6 remote address", false, "[2001:db8::1]:443", "", "2001:db8::1"},
+		{"remote address without port", false, "192.0.2.1", "", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := &RateLimiter{trustForwarded: tt.trustForwarded}
+			r := httptest.NewRequest("GET", "/categories", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if got := rl.clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRateLimiterHeaders sends a client over its burst of 2 at 1 request per second and
+// checks the X-RateLimit-* headers and the 429 body.
+func TestRateLimiterHeaders(t *testing.T) {
+	rl := NewRateLimiter(1, 2, false, time.Minute)
+	defer rl.Close()
+	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		status    int
+		remaining string
+		reset     string
+	}{
+		{http.StatusOK, "1", "1"},
+		{http.StatusOK, "0", "2"},
+		{http.StatusTooManyRequests, "0", "2"},
+	}
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/categories", nil))
+		if w.Code != tt.status {
+			t.Fatalf("request %d: status = %d, want %d", i+1, w.Code, tt.status)
+		}
+		h := w.Header()
+		if h.Get("X-RateLimit-Limit") != "2" || h.Get("X-RateLimit-Remaining") != tt.remaining || h.Get("X-RateLimit-Reset") != tt.reset {
+			t.Errorf("request %d: X-RateLimit-* = %s/%s/%s, want 2/%s/%s", i+1,
+				h.Get("X-RateLimit-Limit"), h.Get("X-RateLimit-Remaining"), h.Get("X-RateLimit-Reset"), tt.remaining, tt.reset)
+		}
+		if w.Code != http.StatusTooManyRequests {
+			continue
+		}
+		var body struct {
+			Limit, Remaining, Reset int
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Limit != 2 || body.Remaining != 0 || body.Reset != 2 {
+			t.Errorf("429 body = %+v, want limit 2, remaining 0, reset 2", body)
+		}
+		if h.Get("Retry-After") != "1" {
+			t.Errorf("Retry-After = %q, want 1", h.Get("Retry-After"))
+		}
+	}
+}
+
+func TestProductPageJSONAPINextLink(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		page     ProductPage
+		wantNext string
+	}{
+		{"last page", "/products?limit=2", ProductPage{Limit: 2}, ""},
+		{"first page", "/products?limit=2", ProductPage{Limit: 2, NextCursor: "abc"}, "/products?cursor=abc&limit=2"},
+		{"replaces cursor and offset", "/products?cursor=old&offset=0&limit=2", ProductPage{Limit: 2, NextCursor: "abc"}, "/products?cursor=abc&limit=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, ok := toJSONAPI(httptest.NewRequest("GET", tt.target, nil), tt.page)
+			if !ok {
+				t.Fatal("toJSONAPI() did not convert a ProductPage")
+			}
+			if got := doc.Links["next"]; got != tt.wantNext {
+				t.Errorf("links.next = %q, want %q", got, tt.wantNext)
+			}
+			if got, _ := doc.Meta["nextCursor"].(string); got != tt.page.NextCursor {
+				t.Errorf("meta.nextCursor = %q, want %q", got, tt.page.NextCursor)
+			}
+		})
+	}
+}
+
+func TestQRCacheFollowsProductURL(t *testing.T) {
+	cache := NewQRCache()
+	product := &Product{ASIN: "B000000001", ProductURL: "https://example.com/a"}
+	before, err := cache.Get(product, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	product.ProductURL = "https://example.com/b"
+	after, err := cache.Get(product, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, after) {
+		t.Error("Get() returned the cached QR code of the old product URL")
+	}
+}
+
+func TestWriteStockErrorNegotiation(t *testing.T) {
+	tests := []struct {
+		name            string
+		accept          string
+		wantContentType string
+		wantMembers     map[string]interface{}
+	}{
+		{"plain JSON", "application/json", "application/json", map[string]interface{}{
+			"error": "product out of stock", "status": 409.0, "asin": "B000000001", "requested": 3.0, "available": 1.0,
+		}},
+		{"problem details", "application/problem+json", "application/problem+json", map[string]interface{}{
+			"type": "/problems/out-of-stock", "title": "Conflict", "status": 409.0, "detail": "product out of stock",
+			"instance": "/add-item-to-basket", "asin": "B000000001", "requested": 3.0, "available": 1.0,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/add-item-to-basket", nil)
+			r.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			writeStockError(w, r, &StockError{ASIN: "B000000001", Requested: 3, Available: 1})
+
+			if w.Code != http.StatusConflict {
+				t.Errorf("status = %d, want 409", w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			var body map[string]interface{}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(body, tt.wantMembers) {
+				t.Errorf("body = %v, want %v", body, tt.wantMembers)
+			}
+		})
+	}
+}
+
+// TestStockErrorIsOutOfStock checks that the shortage errors the stock decrements return are
+// still recognised as ErrOutOfStock after being wrapped, which the handlers rely on for 409.
+func TestStockErrorIsOutOfStock(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"StockError", &StockError{ASIN: "B000000001", Requested: 2, Available: 1}},
+		{"wrapped StockError", fmt.Errorf("checkout: %w", &StockError{ASIN: "B000000001", Requested: 2})},
+		{"BundleError", &BundleError{Shortages: []StockError{{ASIN: "B000000001", Requested: 2}}}},
+	}
+	for _, tt := range tests {
+		if !errors.Is(tt.err, ErrOutOfStock) {
+			t.Errorf("%s does not match ErrOutOfStock", tt.name)
+		}
+	}
+
+	var stockErr *StockError
+	if !errors.As(tests[1].err, &stockErr) || stockErr.Requested != 2 {
+		t.Errorf("errors.As(%v) = %v, want the wrapped *StockError", tests[1].err, stockErr)
+	}
+}
+
+func TestUniqueViolation(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"email taken", &pq.Error{Code: "23505", Constraint: "Users_Email_idx"}, "Users_Email_idx"},
+		{"wrapped", fmt.Errorf("register: %w", &pq.Error{Code: "23505", Constraint: "Users_pkey"}), "Users_pkey"},
+		{"other violation", &pq.Error{Code: "23503", Constraint: "Orders_UserId_fkey"}, ""},
+		{"not a database error", errors.New("boom"), ""},
+		{"no error", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := uniqueViolation(tt.err); got != tt.want {
+			t.Errorf("%s: uniqueViolation() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseProductFilterMaxFilters(t *testing.T) {
+	defer func(old int) { maxFilters = old }(maxFilters)
+
+	all := "/products?has_image=true&minPrice=1&maxPrice=50&minStars=4"
+	tests := []struct {
+		name       string
+		maxFilters int
+		target     string
+		wantErr    error
+	}{
+		{"under the default cap", 8, all, nil},
+		{"at the cap", 4, all, nil},
+		{"over a lower cap", 3, all, ErrTooManyFilters},
+		{"at a lower cap", 2, "/products?minPrice=1&maxPrice=50", nil},
+		{"inactive filter not counted", 1, "/products?has_image=false&minStars=4", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxFilters = tt.maxFilters
+			if _, err := parseProductFilter(httptest.NewRequest("GET", tt.target, nil)); err != tt.wantErr {
+				t.Errorf("parseProductFilter() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestEmptyListsEncodeAsArrays checks that the list helpers that need no database encode
+// an empty result as [] rather than null.
+func TestEmptyListsEncodeAsArrays(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{"buildCategoryTree", buildCategoryTree(nil, nil)},
+		{"buildCategoryTree children", buildCategoryTree(map[string]string{"Books": ""}, nil)[0].Children},
+		{"normalizeCategories", normalizeCategories(nil)},
+		{"normalizeCategories of blanks", normalizeCategories([]string{" ", ""})},
+		{"basketItemResults", basketItemResults(nil, nil)},
+	}
+	for _, tt := range tests {
+		assertJSONArray(t, tt.name, tt.value)
+	}
+}
+
+// TestEmptyListEndpointsEncodeAsArrays runs the database-backed list functions for inputs
+// that match nothing and checks their results encode as [] rather than null.
+func TestEmptyListEndpointsEncodeAsArrays(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	category := fmt.Sprintf("Empty Test %d", time.Now().UnixNano())
+	if err := createCategory(ctx, db, category, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { deleteCategory(ctx, db, category) })
+
+	nothing := fmt.Sprintf("no-such-thing-%d", time.Now().UnixNano())
+	tests := []struct {
+		name string
+		list func() (interface{}, error)
+	}{
+		{"getProductsByCategory", func() (interface{}, error) {
+			page, err := getProductsByCategory(ctx, db, category, ProductFilter{}, "", false, 10, 0, "")
+			return page.Products, err
+		}},
+		{"getProductsInCategories", func() (interface{}, error) {
+			page, err := getProductsInCategories(ctx, db, []string{category}, ProductFilter{}, "", false, 10, 0)
+			return page.Products, err
+		}},
+		{"searchProducts", func() (interface{}, error) {
+			return searchProducts(ctx, db, nothing, "relevance", ProductFilter{}, 10, false)
+		}},
+		{"fullTextSearch", func() (interface{}, error) {
+			return fullTextSearch(ctx, db, nothing, "", ProductFilter{}, 10, 0, false)
+		}},
+		{"getRecentlyViewed", func() (interface{}, error) { return getRecentlyViewed(ctx, db, nothing, 10) }},
+		{"getFrequentlyBoughtTogether", func() (interface{}, error) { return getFrequentlyBoughtTogether(ctx, db, nothing, 10) }},
+		{"getOrders", func() (interface{}, error) { return getOrders(ctx, db, nothing) }},
+		{"getDeterministicSample", func() (interface{}, error) { return getDeterministicSample(ctx, db, nothing, 0, 10) }},
+		{"getBestSellers", func() (interface{}, error) { return getBestSellers(ctx, db, 0) }},
+		{"getTopSpenders", func() (interface{}, error) { return getTopSpenders(ctx, db, 0) }},
+		{"getLowStockProducts", func() (interface{}, error) { return getLowStockProducts(ctx, db, -1, false, 10) }},
+		{"getNewProducts", func() (interface{}, error) {
+			page, err := getNewProducts(ctx, db, ProductFilter{}, 10, 1<<30)
+			return page.Products, err
+		}},
+	}
+	for _, tt := range tests {
+		value, err := tt.list()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		assertJSONArray(t, tt.name, value)
+	}
+}
+
+// TestCategoriesIgnoreCase checks that a category spelled in another case by its products is
+// listed once, under the Categories table's name, with the products of every spelling counted.
+func TestCategoriesIgnoreCase(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	category := fmt.Sprintf("Case Test %d", time.Now().UnixNano())
+	if err := createCategory(ctx, db, category, ""); err != nil {
+		t.Fatal(err)
+	}
+	asin := fmt.Sprintf("TEST%d", time.Now().UnixNano())
+	if err := createProduct(ctx, db, Product{ASIN: asin, Title: "Lower-cased", CategoryName: category, Price: 1}, 1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM "StockHistory" WHERE "asin" = $1`, asin)
+		db.Exec(`DELETE FROM "ProductCounts" WHERE "asin" = $1`, asin)
+		db.Exec(`DELETE FROM "Products" WHERE "asin" = $1`, asin)
+		deleteCategory(ctx, db, category)
+	})
+	if _, err := db.Exec(`UPDATE "Products" SET "categoryName" = $2 WHERE "asin" = $1`, asin, strings.ToLower(category)); err != nil {
+		t.Fatal(err)
+	}
+
+	categories, err := getCategoriesWithCounts(ctx, db, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []CategoryWithCount
+	for _, c := range categories {
+		if strings.EqualFold(c.Name, category) {
+			found = append(found, c)
+		}
+	}
+	want := []CategoryWithCount{{Category{category}, 1}}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("getCategoriesWithCounts lists %v, want %v", found, want)
+	}
+}
+
+// TestNewProductsExcludeDeleted checks that a soft-deleted product drops out of the new
+// products feed, from both the page and its total.
+func TestNewProductsExcludeDeleted(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	asin := fmt.Sprintf("TEST%d", time.Now().UnixNano())
+	if err := createProduct(ctx, db, Product{ASIN: asin, Title: "Withdrawn", CategoryName: "Test", Price: 1}, 1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM "StockHistory" WHERE "asin" = $1`, asin)
+		db.Exec(`DELETE FROM "ProductCounts" WHERE "asin" = $1`, asin)
+		db.Exec(`DELETE FROM "Products" WHERE "asin" = $1`, asin)
+	})
+
+	before, err := getNewProducts(ctx, db, ProductFilter{}, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before.Products) != 1 || before.Products[0].ASIN != asin {
+		t.Fatalf("newest product is %v, want %s", before.Products, asin)
+	}
+
+	if _, err := db.Exec(`UPDATE "Products" SET "deletedAt" = now() WHERE "asin" = $1`, asin); err != nil {
+		t.Fatal(err)
+	}
+	after, err := getNewProducts(ctx, db, ProductFilter{}, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after.Products) == 1 && after.Products[0].ASIN == asin {
+		t.Errorf("soft-deleted product %s is still listed", asin)
+	}
+	if after.Total != before.Total-1 {
+		t.Errorf("Total = %d after deleting, want %d", after.Total, before.Total-1)
+	}
+}
+
+// TestSearchProductsMatchesLiterally checks that % and _ in a search query only match
+// themselves rather than acting as LIKE wildcards.
+func TestSearchProductsMatchesLiterally(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	marker := fmt.Sprintf("LikeTest%d", time.Now().UnixNano())
+	titles := map[string]string{
+		marker + "A": marker + " 50% off",
+		marker + "B": marker + " 500 off",
+		marker + "C": marker + " a_b",
+		marker + "D": marker + " axb",
+	}
+	for asin, title := range titles {
+		if err := createProduct(ctx, db, Product{ASIN: asin, Title: title, CategoryName: "Test", Price: 1}, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for asin := range titles {
+			db.Exec(`DELETE FROM "StockHistory" WHERE "asin" = $1`, asin)
+			db.Exec(`DELETE FROM "ProductCounts" WHERE "asin" = $1`, asin)
+			db.Exec(`DELETE FROM "Products" WHERE "asin" = $1`, asin)
+		}
+	})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{marker + " 50%", []string{marker + "A"}},
+		{marker + " a_b", []string{marker + "C"}},
+		{marker + " %", nil},
+		{marker + " _", nil},
+	}
+	for _, tt := range tests {
+		results, err := searchProducts(ctx, db, tt.query, "relevance", ProductFilter{}, 10, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, result := range results {
+			got = append(got, result.ASIN)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchProducts(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+// TestProductsByCategoryNormalizesLookup checks that a category lookup with stray whitespace
+// and different case finds the products of the category.
+func TestProductsByCategoryNormalizesLookup(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	stamp := time.Now().UnixNano()
+	asin := fmt.Sprintf("TEST%d", stamp)
+	category := fmt.Sprintf("Normalize Test %d", stamp)
+	if err := createProduct(ctx, db, Product{ASIN: asin, Title: "Normalized", CategoryName: category, Price: 1}, 1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM "StockHistory" WHERE "asin" = $1`, asin)
+		db.Exec(`DELETE FROM "ProductCounts" WHERE "asin" = $1`, asin)
+		db.Exec(`DELETE FROM "Products" WHERE "asin" = $1`, asin)
+	})
+
+	lookup := fmt.Sprintf("  normalize \t TEST %d ", stamp)
+	page, err := getProductsByCategory(ctx, db, normalizeCategory(lookup), ProductFilter{}, "", false, 10, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || len(page.Products) != 1 || page.Products[0].ASIN != asin {
+		t.Errorf("category %q lists %v, want %s", lookup, page.Products, asin)
+	}
+}
+
+// TestTopSpendersSumOrders checks that spend comes from the order totals, counting every
+// placed order of a user and leaving cancelled ones out.
+func TestTopSpendersSumOrders(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	userID := fmt.Sprintf("spender-%d", time.Now().UnixNano())
+	for _, order := range []struct {
+		total  float64
+		status string
+	}{{3e12, "placed"}, {1e12, "placed"}, {5e12, "cancelled"}} {
+		if _, err := db.Exec(`INSERT INTO "Orders" ("UserId", "BasketId", "Status", "Total") VALUES ($1, $1, $2, $3)`, userID, order.status, order.total); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM "Orders" WHERE "UserId" = $1`, userID) })
+
+	spenders, err := getTopSpenders(ctx, db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UserSpend{{UserID: userID, TotalSpend: 4e12, OrderCount: 2, LargestOrder: 3e12}}
+	if !reflect.DeepEqual(spenders, want) {
+		t.Errorf("getTopSpenders = %+v, want %+v", spenders, want)
+	}
+}
+
+// TestCreateUserEmailTaken checks that registering an email again, in another case, reports
+// ErrUserExists.
+func TestCreateUserEmailTaken(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	email := fmt.Sprintf("taken-%d@example.com", time.Now().UnixNano())
+	if _, err := createUser(ctx, db, email, "password123"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM "Users" WHERE lower("Email") = lower($1)`, email) })
+
+	if _, err := createUser(ctx, db, strings.ToUpper(email), "password123"); err != ErrUserExists {
+		t.Errorf("createUser with a taken email = %v, want ErrUserExists", err)
+	}
+}
+
+// assertJSONArray fails the test unless value encodes as an empty JSON array.
+func assertJSONArray(t *testing.T, name string, value interface{}) {
+	t.Helper()
+	b, err := json.Marshal(value)
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	if string(b) != "[]" {
+		t.Errorf("%s encodes as %s, want []", name, b)
+	}
+}
+
+// TestMigrationsRecordThemselves checks that every migration is recorded in
+// "SchemaMigrations" by a migration file, so GET /readyz also sees migrations applied with psql.
+func TestMigrationsRecordThemselves(t *testing.T) {
+	names, err := migrationNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scripts strings.Builder
+	for _, name := range names {
+		script, err := migrations.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scripts.Write(script)
+	}
+	for _, name := range names {
+		if !strings.Contains(scripts.String(), "('"+path.Base(name)+"')") {
+			t.Errorf("%s is not recorded in SchemaMigrations by any migration", path.Base(name))
+		}
+	}
+}
+
+// TestRunMigrationsSkipsApplied checks that running the migrations again leaves data alone:
+// 015_basket_owners.sql would drop an ownerless version row of an empty basket if it ran twice.
+func TestRunMigrationsSkipsApplied(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	basketID := fmt.Sprintf("migrations-test-%d", time.Now().UnixNano())
+	if _, err := db.Exec(`INSERT INTO "BasketVersions" ("BasketId") VALUES ($1)`, basketID); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM "BasketVersions" WHERE "BasketId" = $1`, basketID) })
+
+	if err := runMigrations(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "BasketVersions" WHERE "BasketId" = $1)`, basketID).Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Error("running the migrations again reapplied 015_basket_owners.sql")
+	}
+}
+
+// testDB connects to TEST_DATABASE_URL and applies the migrations, skipping the test when
+// the variable is unset.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := runMigrations(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestAddItemToBasketConcurrentStock adds the last unit of a product to many baskets at once
+// and expects exactly one to get it.
+func TestAddItemToBasketConcurrentStock(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	asin := fmt.Sprintf("TEST%d", time.Now().UnixNano())
+	product := Product{ASIN: asin, Title: "Last unit", CategoryName: "Test", Price: 1}
+	if err := createProduct(ctx, db, product, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every client gets its own basket, whose version row records the client as its owner
+	const clients = 20
+	basketIDs := make([]string, clients)
+	for i := range basketIDs {
+		basketIDs[i] = fmt.Sprintf("%s-%d", asin, i)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM "Baskets" WHERE "BasketId" = ANY($1)`, pq.Array(basketIDs))
+		db.Exec(`DELETE FROM "BasketVersions" WHERE "BasketId" = ANY($1)`, pq.Array(basketIDs))
+		db.Exec(`DELETE FROM "StockHistory" WHERE "asin" = $1`, asin)
+		db.Exec(`DELETE FROM "ProductCounts" WHERE "asin" = $1`, asin)
+		db.Exec(`DELETE FROM "Products" WHERE "asin" = $1`, asin)
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := addItemToBasket(ctx, db, asin, fmt.Sprintf("user-%d", i), basketIDs[i], 1, nil)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		var stockErr *StockError
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.As(err, &stockErr):
+			if stockErr.Available != 0 {
+				t.Errorf("StockError.Available = %d, want 0", stockErr.Available)
+			}
+		default:
+			t.Errorf("addItemToBasket: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d baskets got the last unit, want 1", succeeded)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT "count" FROM "ProductCounts" WHERE "asin" = $1`, asin).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("stock = %d, want 0", count)
+	}
+}
+
+// TestAddItemToBasketConcurrentQuantity has many baskets ask for 2 of the 3 units of a product
+// at once and expects exactly one to get them, leaving 1 unit that the others are told about.
+func TestAddItemToBasketConcurrentQuantity(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	asin := fmt.Sprintf("TEST%d", time.Now().UnixNano())
+	product := Product{ASIN: asin, Title: "Three units", CategoryName: "Test", Price: 1}
+	if err := createProduct(ctx, db, product, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	const clients = 10
+	basketIDs := make([]string, clients)
+	for i := range basketIDs {
+		basketIDs[i] = fmt.Sprintf("%s-%d", asin, i)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM "Baskets" WHERE "BasketId" = ANY($1)`, pq.Array(basketIDs))
+		db.Exec(`DELETE FROM "BasketVersions" WHERE "BasketId" = ANY($1)`, pq.Array(basketIDs))
+		db.Exec(`DELETE FROM "StockHistory" WHERE "asin" = $1`, asin)
+		db.Exec(`DELETE FROM "ProductCounts" WHERE "asin" = $1`, asin)
+		db.Exec(`DELETE FROM "Products" WHERE "asin" = $1`, asin)
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := addItemToBasket(ctx, db, asin, fmt.Sprintf("user-%d", i), basketIDs[i], 2, nil)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		var stockErr *StockError
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.As(err, &stockErr):
+			if stockErr.Requested != 2 || stockErr.Available != 1 {
+				t.Errorf("StockError = %+v, want 2 requested and 1 available", *stockErr)
+			}
+		default:
+			t.Errorf("addItemToBasket: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d baskets got 2 units, want 1", succeeded)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT "count" FROM "ProductCounts" WHERE "asin" = $1`, asin).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("stock = %d, want 1", count)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// statusRecorder wraps a ResponseWriter to remember the status code written to it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// routeKey identifies one row of the request metrics.
+type routeKey struct {
+	Method string
+	Route  string
+	Status int
+}
+
+// routeStats holds the counters for one routeKey.
+type routeStats struct {
+	count         atomic.Int64
+	totalDuration atomic.Int64
+}
+
+// Metrics is an in-memory request metrics collector. It is safe for concurrent use and
+// works whether or not any external metrics system is configured.
+type Metrics struct {
+	mu       sync.RWMutex
+	routes   map[routeKey]*routeStats
+	requests atomic.Int64
+	errors   atomic.Int64
+}
+
+// RouteMetrics is the JSON form of the counters for one route and status.
+type RouteMetrics struct {
+	Method       string  `json:"method"`
+	Route        string  `json:"route"`
+	Status       int     `json:"status"`
+	Count        int64   `json:"count"`
+	AvgLatencyMs float64 `json:"avgLatencyMs"`
+}
+
+// MetricsSnapshot is the JSON document served by the admin metrics endpoint.
+type MetricsSnapshot struct {
+	Requests int64          `json:"requests"`
+	Errors   int64          `json:"errors"`
+	Routes   []RouteMetrics `json:"routes"`
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{routes: make(map[routeKey]*routeStats)}
+}
+
+// Observe records one request. Responses with a 5xx status count as errors.
+func (m *Metrics) Observe(method, route string, status int, duration time.Duration) {
+	key := routeKey{Method: method, Route: route, Status: status}
+
+	m.mu.RLock()
+	stats, ok := m.routes[key]
+	m.mu.RUnlock()
+	if !ok {
+		m.mu.Lock()
+		if stats, ok = m.routes[key]; !ok {
+			stats = &routeStats{}
+			m.routes[key] = stats
+		}
+		m.mu.Unlock()
+	}
+
+	stats.count.Add(1)
+	stats.totalDuration.Add(int64(duration))
+	m.requests.Add(1)
+	if status >= 500 {
+		m.errors.Add(1)
+	}
+}
+
+// Snapshot returns the current counters, clearing them when reset is set.
+func (m *Metrics) Snapshot(reset bool) MetricsSnapshot {
+	var routes map[routeKey]*routeStats
+	var snapshot MetricsSnapshot
+	if reset {
+		m.mu.Lock()
+		routes = m.routes
+		m.routes = make(map[routeKey]*routeStats)
+		snapshot.Requests = m.requests.Swap(0)
+		snapshot.Errors = m.errors.Swap(0)
+		m.mu.Unlock()
+	} else {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		routes = m.routes
+		snapshot.Requests = m.requests.Load()
+		snapshot.Errors = m.errors.Load()
+	}
+
+	snapshot.Routes = make([]RouteMetrics, 0, len(routes))
+	for key, stats := range routes {
+		count := stats.count.Load()
+		route := RouteMetrics{Method: key.Method, Route: key.Route, Status: key.Status, Count: count}
+		if count > 0 {
+			route.AvgLatencyMs = float64(stats.totalDuration.Load()) / float64(count) / float64(time.Millisecond)
+		}
+		snapshot.Routes = append(snapshot.Routes, route)
+	}
+
+	sort.Slice(snapshot.Routes, func(i, j int) bool {
+		a, b := snapshot.Routes[i], snapshot.Routes[j]
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Status < b.Status
+	})
+
+	return snapshot
+}
+
+// RequestObserver records the outcome of a request.
+type RequestObserver interface {
+	Observe(method, route string, status int, duration time.Duration)
+}
+
+// routeTemplate returns the path template of the mux route handling r, e.g.
+// "/products/{asin}", or the request path outside of a route.
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tpl, err := current.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return r.URL.Path
+}
+
+// observeRequests reports every request routed through the mux router to each observer,
+// keyed by the route's path template so that /products/A and /products/B are counted together.
+func observeRequests(observers ...RequestObserver) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			duration := time.Since(start)
+
+			route := routeTemplate(r)
+			for _, observer := range observers {
+				observer.Observe(r.Method, route, rec.status, duration)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// migrations holds the SQL files in migrations/. Every file is idempotent, so one that was
+// applied without being recorded can safely be applied again.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// runMigrations applies the pending embedded migrations in file name order, each file in its
+// own transaction, logging every statement it runs. The migrations record themselves in
+// "SchemaMigrations", so applying them with psql instead leaves the same record behind, and
+// files recorded there are skipped rather than rewriting data on every startup.
+func runMigrations(ctx context.Context, db *sql.DB) error {
+	names, err := pendingMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		script, err := migrations.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return err
+		}
+		if err := applyMigration(ctx, db, name, string(script)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrationNames returns the paths of the embedded migrations in file name order.
+func migrationNames() ([]string, error) {
+	names, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// pendingMigrations returns the file names of the embedded migrations that are not recorded
+// as applied to db. All of them are pending while "SchemaMigrations" does not exist.
+func pendingMigrations(ctx context.Context, db *sql.DB) ([]string, error) {
+	names, err := migrationNames()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]string, 0)
+	for _, name := range names {
+		if !applied[path.Base(name)] {
+			pending = append(pending, path.Base(name))
+		}
+	}
+	return pending, nil
+}
+
+// appliedMigrations returns the file names recorded in "SchemaMigrations", or none when the
+// table does not exist yet.
+func appliedMigrations(ctx context.Context, db *sql.DB) (map[string]bool, error) {
+	applied := make(map[string]bool)
+	rows, err := db.QueryContext(ctx, "SELECT \"Name\" FROM \"SchemaMigrations\"")
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "42P01" {
+			return applied, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		applied[name] = true
+	}
+	return applied, rows.Err()
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, name, script string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range splitStatements(script) {
+		slog.Info("applying migration", "migration", name, "statement", strings.Join(strings.Fields(stmt), " "))
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// splitStatements splits a migration script into its statements, dropping "--" comment
+// lines. The migrations don't contain semicolons inside statements, so a semicolon at the
+// end of a line always ends one.
+func splitStatements(script string) []string {
+	var stmts []string
+	var current strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSpace(current.String()))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		stmts = append(stmts, rest)
+	}
+	return stmts
+}
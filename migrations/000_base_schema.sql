@@ -0,0 +1,32 @@
+-- Base tables the service needs. They already exist in the restored backup, so this only
+-- creates them in a fresh database.
+CREATE TABLE IF NOT EXISTS "Products" (
+    "asin"              TEXT    PRIMARY KEY,
+    "title"             TEXT    NOT NULL,
+    "imgUrl"            TEXT    NOT NULL DEFAULT '',
+    "productUrl"        TEXT    NOT NULL DEFAULT '',
+    "stars"             REAL    NOT NULL DEFAULT 0,
+    "reviews"           INTEGER NOT NULL DEFAULT 0,
+    "price"             REAL    NOT NULL DEFAULT 0,
+    "isBestSeller"      BOOLEAN NOT NULL DEFAULT false,
+    "boughtInLastMonth" INTEGER NOT NULL DEFAULT 0,
+    "categoryName"      TEXT    NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS "Products_categoryName_idx" ON "Products" ("categoryName");
+
+CREATE TABLE IF NOT EXISTS "ProductCounts" (
+    "asin"  TEXT    PRIMARY KEY,
+    "count" INTEGER NOT NULL DEFAULT 0
+);
+
+-- One row per unit of a product in a basket.
+CREATE TABLE IF NOT EXISTS "Baskets" (
+    "BasketId"     TEXT    NOT NULL,
+    "ProductId"    TEXT    NOT NULL,
+    "UserId"       TEXT    NOT NULL,
+    "IsCheckedOut" BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE INDEX IF NOT EXISTS "Baskets_BasketId_idx" ON "Baskets" ("BasketId");
+CREATE INDEX IF NOT EXISTS "Baskets_UserId_idx" ON "Baskets" ("UserId");
@@ -0,0 +1,2 @@
+-- Per-unit shipping weight in kilograms. NULL means the weight is unknown.
+ALTER TABLE "Products" ADD COLUMN IF NOT EXISTS "weight" REAL;
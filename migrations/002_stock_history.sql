@@ -0,0 +1,11 @@
+-- Audit trail of every change made to "ProductCounts"."count" outside the basket flow.
+CREATE TABLE IF NOT EXISTS "StockHistory" (
+    "id"        BIGSERIAL PRIMARY KEY,
+    "asin"      TEXT        NOT NULL,
+    "delta"     INTEGER     NOT NULL,
+    "count"     INTEGER     NOT NULL,
+    "reason"    TEXT        NOT NULL,
+    "createdAt" TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS "StockHistory_asin_idx" ON "StockHistory" ("asin", "createdAt");
@@ -0,0 +1,9 @@
+-- Products viewed by each user, used for the recently-viewed strip.
+CREATE TABLE IF NOT EXISTS "ProductViews" (
+    "id"        BIGSERIAL PRIMARY KEY,
+    "user_id"   TEXT        NOT NULL,
+    "asin"      TEXT        NOT NULL,
+    "viewed_at" TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS "ProductViews_user_idx" ON "ProductViews" ("user_id", "viewed_at" DESC);
@@ -0,0 +1,4 @@
+-- When a product was added to the catalogue. Existing products get the time of the migration.
+ALTER TABLE "Products" ADD COLUMN IF NOT EXISTS "createdAt" TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS "Products_createdAt_idx" ON "Products" ("createdAt" DESC, "asin");
@@ -0,0 +1,5 @@
+-- Optimistic concurrency token per basket, incremented on every basket mutation.
+CREATE TABLE IF NOT EXISTS "BasketVersions" (
+    "BasketId" TEXT   PRIMARY KEY,
+    "Version"  BIGINT NOT NULL DEFAULT 0
+);
@@ -0,0 +1,5 @@
+-- Category metadata. A category with no row here, or with a NULL parent, is a top-level category.
+CREATE TABLE IF NOT EXISTS "Categories" (
+    "name"           TEXT PRIMARY KEY,
+    "parentCategory" TEXT NULL
+);
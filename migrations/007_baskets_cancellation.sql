@@ -0,0 +1,3 @@
+-- When a basket was checked out, and whether the resulting order was cancelled afterwards.
+ALTER TABLE "Baskets" ADD COLUMN IF NOT EXISTS "CheckedOutAt" TIMESTAMPTZ NULL;
+ALTER TABLE "Baskets" ADD COLUMN IF NOT EXISTS "IsCancelled" BOOLEAN NOT NULL DEFAULT false;
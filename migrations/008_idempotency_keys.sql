@@ -0,0 +1,10 @@
+-- Idempotency keys of processed checkouts, scoped per user, so replayed requests return the
+-- original result instead of checking out again.
+CREATE TABLE IF NOT EXISTS "IdempotencyKeys" (
+    "UserId"    TEXT        NOT NULL,
+    "Key"       TEXT        NOT NULL,
+    "BasketId"  TEXT        NOT NULL,
+    "Version"   BIGINT      NULL,
+    "CreatedAt" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY ("UserId", "Key")
+);
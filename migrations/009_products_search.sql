@@ -0,0 +1,4 @@
+-- Full-text search over product titles and categories. The expression must match
+-- searchDocument in search.go for the index to be used.
+CREATE INDEX IF NOT EXISTS "Products_search_idx" ON "Products"
+    USING GIN (to_tsvector('english', coalesce("title", '') || ' ' || coalesce("categoryName", '')));
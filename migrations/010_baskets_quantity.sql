@@ -0,0 +1,23 @@
+-- Baskets holds one row per product with the number of units in "Quantity", instead of one
+-- row per unit. Existing rows of the same product in the same state are merged into one.
+ALTER TABLE "Baskets" ADD COLUMN IF NOT EXISTS "Quantity" INTEGER NOT NULL DEFAULT 1 CHECK ("Quantity" > 0);
+
+UPDATE "Baskets" b SET "Quantity" = m."total"
+FROM (
+    SELECT "BasketId", "ProductId", "UserId", "IsCheckedOut", "CheckedOutAt", "IsCancelled", SUM("Quantity") AS "total"
+    FROM "Baskets"
+    GROUP BY "BasketId", "ProductId", "UserId", "IsCheckedOut", "CheckedOutAt", "IsCancelled"
+    HAVING COUNT(*) > 1
+) m
+WHERE b."BasketId" = m."BasketId" AND b."ProductId" = m."ProductId" AND b."UserId" = m."UserId"
+    AND b."IsCheckedOut" = m."IsCheckedOut" AND b."CheckedOutAt" IS NOT DISTINCT FROM m."CheckedOutAt"
+    AND b."IsCancelled" = m."IsCancelled";
+
+DELETE FROM "Baskets" a
+USING "Baskets" b
+WHERE a."BasketId" = b."BasketId" AND a."ProductId" = b."ProductId" AND a."UserId" = b."UserId"
+    AND a."IsCheckedOut" = b."IsCheckedOut" AND a."CheckedOutAt" IS NOT DISTINCT FROM b."CheckedOutAt"
+    AND a."IsCancelled" = b."IsCancelled" AND a.ctid > b.ctid;
+
+-- Adding a product already in an open basket upserts on this index
+CREATE UNIQUE INDEX IF NOT EXISTS "Baskets_open_item_idx" ON "Baskets" ("BasketId", "ProductId", "UserId") WHERE "IsCheckedOut" = false;
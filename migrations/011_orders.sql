@@ -0,0 +1,25 @@
+-- Orders created by checkout. Each order item keeps the product's title and price at the
+-- time of purchase, so later catalogue changes don't rewrite past orders.
+CREATE TABLE IF NOT EXISTS "Orders" (
+    "OrderId"     BIGSERIAL        PRIMARY KEY,
+    "UserId"      TEXT             NOT NULL,
+    "BasketId"    TEXT             NOT NULL,
+    "Status"      TEXT             NOT NULL DEFAULT 'placed',
+    "Total"       DOUBLE PRECISION NOT NULL,
+    "CreatedAt"   TIMESTAMPTZ      NOT NULL DEFAULT now(),
+    "CancelledAt" TIMESTAMPTZ      NULL
+);
+
+CREATE INDEX IF NOT EXISTS "Orders_UserId_idx" ON "Orders" ("UserId", "CreatedAt" DESC);
+
+CREATE TABLE IF NOT EXISTS "OrderItems" (
+    "OrderId"   BIGINT  NOT NULL REFERENCES "Orders" ("OrderId") ON DELETE CASCADE,
+    "ProductId" TEXT    NOT NULL,
+    "Title"     TEXT    NOT NULL,
+    "Price"     REAL    NOT NULL,
+    "Quantity"  INTEGER NOT NULL,
+    PRIMARY KEY ("OrderId", "ProductId")
+);
+
+-- Replayed checkouts return the order the original request created
+ALTER TABLE "IdempotencyKeys" ADD COLUMN IF NOT EXISTS "OrderId" BIGINT NULL;
@@ -0,0 +1,21 @@
+-- Create orders for baskets checked out before checkout created them. Prices at the time of
+-- purchase weren't recorded, so the current product prices are used.
+INSERT INTO "Orders" ("UserId", "BasketId", "Status", "Total", "CreatedAt", "CancelledAt")
+SELECT b."UserId", b."BasketId",
+    CASE WHEN bool_and(b."IsCancelled") THEN 'cancelled' ELSE 'placed' END,
+    COALESCE(SUM(p."price"::float8 * b."Quantity"), 0),
+    COALESCE(MIN(b."CheckedOutAt"), now()),
+    CASE WHEN bool_and(b."IsCancelled") THEN COALESCE(MIN(b."CheckedOutAt"), now()) END
+FROM "Baskets" b
+LEFT JOIN "Products" p ON p."asin" = b."ProductId"
+WHERE b."IsCheckedOut" = true
+    AND NOT EXISTS (SELECT 1 FROM "Orders" o WHERE o."UserId" = b."UserId" AND o."BasketId" = b."BasketId")
+GROUP BY b."UserId", b."BasketId";
+
+INSERT INTO "OrderItems" ("OrderId", "ProductId", "Title", "Price", "Quantity")
+SELECT o."OrderId", b."ProductId", COALESCE(p."title", ''), COALESCE(p."price", 0), SUM(b."Quantity")
+FROM "Orders" o
+JOIN "Baskets" b ON b."UserId" = o."UserId" AND b."BasketId" = o."BasketId" AND b."IsCheckedOut" = true
+LEFT JOIN "Products" p ON p."asin" = b."ProductId"
+WHERE NOT EXISTS (SELECT 1 FROM "OrderItems" i WHERE i."OrderId" = o."OrderId")
+GROUP BY o."OrderId", b."ProductId", p."title", p."price";
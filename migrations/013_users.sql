@@ -0,0 +1,10 @@
+-- Registered users. Baskets and orders refer to them by "UserId"; guests keep using random
+-- user IDs that have no row here.
+CREATE TABLE IF NOT EXISTS "Users" (
+    "UserId"       TEXT        PRIMARY KEY,
+    "Email"        TEXT        NOT NULL,
+    "PasswordHash" TEXT        NOT NULL,
+    "CreatedAt"    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS "Users_Email_idx" ON "Users" (lower("Email"));
@@ -0,0 +1,26 @@
+-- Names of the migration files applied to this database, which GET /readyz checks against the
+-- migrations the service was built with. Every migration from this one on records itself as
+-- its last statement, so files applied with psql are recorded too; the files before it must
+-- have been applied already, so they are recorded here.
+CREATE TABLE IF NOT EXISTS "SchemaMigrations" (
+    "Name"      TEXT        PRIMARY KEY,
+    "AppliedAt" TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO "SchemaMigrations" ("Name") VALUES
+    ('000_base_schema.sql'),
+    ('001_products_weight.sql'),
+    ('002_stock_history.sql'),
+    ('003_product_views.sql'),
+    ('004_products_created_at.sql'),
+    ('005_basket_versions.sql'),
+    ('006_categories.sql'),
+    ('007_baskets_cancellation.sql'),
+    ('008_idempotency_keys.sql'),
+    ('009_products_search.sql'),
+    ('010_baskets_quantity.sql'),
+    ('011_orders.sql'),
+    ('012_backfill_orders.sql'),
+    ('013_users.sql'),
+    ('014_schema_migrations.sql')
+ON CONFLICT ("Name") DO NOTHING;
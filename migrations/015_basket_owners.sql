@@ -0,0 +1,24 @@
+-- The user each basket belongs to, recorded on its version row, which every basket mutation
+-- locks. Baskets whose rows all belong to one user are assigned to that user. Baskets holding
+-- rows of several users keep a NULL owner and can no longer be read or changed.
+ALTER TABLE "BasketVersions" ADD COLUMN IF NOT EXISTS "UserId" TEXT NULL;
+
+INSERT INTO "BasketVersions" ("BasketId")
+SELECT DISTINCT "BasketId" FROM "Baskets"
+ON CONFLICT ("BasketId") DO NOTHING;
+
+UPDATE "BasketVersions" v SET "UserId" = o."UserId"
+FROM (
+    SELECT "BasketId", MIN("UserId") AS "UserId"
+    FROM "Baskets"
+    GROUP BY "BasketId"
+    HAVING COUNT(DISTINCT "UserId") = 1
+) o
+WHERE v."BasketId" = o."BasketId" AND v."UserId" IS NULL;
+
+-- Version rows of baskets that were emptied before owners were recorded are dropped, so the
+-- next user to add to the basket claims it
+DELETE FROM "BasketVersions" v
+WHERE v."UserId" IS NULL AND NOT EXISTS (SELECT 1 FROM "Baskets" b WHERE b."BasketId" = v."BasketId");
+
+INSERT INTO "SchemaMigrations" ("Name") VALUES ('015_basket_owners.sql') ON CONFLICT ("Name") DO NOTHING;
@@ -0,0 +1,17 @@
+-- Category names are unique regardless of case, like the lookups that compare them with lower().
+-- Rows that differ from another only in case are dropped first, keeping the first name in
+-- byte order, and subcategories of a dropped row move to the row that is kept.
+UPDATE "Categories" c SET "parentCategory" = k."name"
+FROM (
+    SELECT lower("name") AS "lowered", MIN("name") AS "name"
+    FROM "Categories"
+    GROUP BY lower("name")
+) k
+WHERE lower(c."parentCategory") = k."lowered" AND c."parentCategory" <> k."name";
+
+DELETE FROM "Categories" c
+WHERE EXISTS (SELECT 1 FROM "Categories" o WHERE lower(o."name") = lower(c."name") AND o."name" < c."name");
+
+CREATE UNIQUE INDEX IF NOT EXISTS "Categories_lower_name_idx" ON "Categories" (lower("name"));
+
+INSERT INTO "SchemaMigrations" ("Name") VALUES ('016_categories_lower_name.sql') ON CONFLICT ("Name") DO NOTHING;
@@ -0,0 +1,5 @@
+-- Category lookups compare lower("categoryName"), which the plain index on "categoryName"
+-- can't serve.
+CREATE INDEX IF NOT EXISTS "Products_lower_categoryName_idx" ON "Products" (lower("categoryName"));
+
+INSERT INTO "SchemaMigrations" ("Name") VALUES ('017_products_lower_category.sql') ON CONFLICT ("Name") DO NOTHING;
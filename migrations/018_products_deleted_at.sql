@@ -0,0 +1,5 @@
+-- When a product was withdrawn from the catalogue; NULL while it is still listed. Soft-deleted
+-- products stay in "Products" so past orders and stock history keep referring to them.
+ALTER TABLE "Products" ADD COLUMN IF NOT EXISTS "deletedAt" TIMESTAMPTZ NULL;
+
+INSERT INTO "SchemaMigrations" ("Name") VALUES ('018_products_deleted_at.sql') ON CONFLICT ("Name") DO NOTHING;
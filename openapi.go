@@ -0,0 +1,755 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// The types below are the subset of the OpenAPI 3.0 document model used by openAPISpec.
+
+type openAPIDocument struct {
+	OpenAPI    string                                 `json:"openapi"`
+	Info       openAPIInfo                            `json:"info"`
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components openAPIComponents                      `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema        `json:"schemas"`
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPISecurityScheme struct {
+	Type         string `json:"type"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+}
+
+type openAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+	Security    []map[string][]string      `json:"security,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Required    bool           `json:"required,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Minimum              *float64                  `json:"minimum,omitempty"`
+	Maximum              *float64                  `json:"maximum,omitempty"`
+	Default              interface{}               `json:"default,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	AllOf                []*openAPISchema          `json:"allOf,omitempty"`
+	OneOf                []*openAPISchema          `json:"oneOf,omitempty"`
+}
+
+// Schema shorthands.
+
+func ref(name string) *openAPISchema { return &openAPISchema{Ref: "#/components/schemas/" + name} }
+func arrayOf(items *openAPISchema) *openAPISchema {
+	return &openAPISchema{Type: "array", Items: items}
+}
+func mapOf(values *openAPISchema) *openAPISchema {
+	return &openAPISchema{Type: "object", AdditionalProperties: values}
+}
+func object(properties map[string]*openAPISchema, required ...string) *openAPISchema {
+	return &openAPISchema{Type: "object", Properties: properties, Required: required}
+}
+
+func bound(v float64) *float64 { return &v }
+
+var (
+	stringSchema  = &openAPISchema{Type: "string"}
+	integerSchema = &openAPISchema{Type: "integer"}
+	numberSchema  = &openAPISchema{Type: "number"}
+	booleanSchema = &openAPISchema{Type: "boolean"}
+)
+
+// Parameter shorthands.
+
+func pathParam(name string) openAPIParameter {
+	return openAPIParameter{Name: name, In: "path", Required: true, Schema: stringSchema}
+}
+
+func queryParam(name string, schema *openAPISchema, description string) openAPIParameter {
+	return openAPIParameter{Name: name, In: "query", Schema: schema, Description: description}
+}
+
+func limitParam(def, max int) openAPIParameter {
+	return queryParam("limit", &openAPISchema{Type: "integer", Default: def},
+		"Maximum number of results, capped at "+strconv.Itoa(max))
+}
+
+var (
+	offsetParam  = queryParam("offset", &openAPISchema{Type: "integer", Default: 0}, "Number of results to skip")
+	ifMatchParam = openAPIParameter{Name: "If-Match", In: "header", Schema: stringSchema,
+		Description: "Optional basket version from a previous ETag; the request fails with 409 when the basket changed since. " +
+			"Without it the change is applied to whatever the basket holds, so clients that edit a basket from several places should send it"}
+	includeParam = queryParam("include", &openAPISchema{Type: "string", Enum: []string{"stock"}},
+		"Comma-separated extras; stock adds each product's available units")
+	formatPricesParam = queryParam("format_prices", booleanSchema, "Add a locale-formatted price_display to products")
+	localeParam       = queryParam("locale", stringSchema, "BCP 47 locale used by format_prices")
+	sortParam         = queryParam("sort", &openAPISchema{Type: "string", Enum: []string{"price", "stars", "reviews", "price_asc", "price_desc", "stars_asc", "stars_desc", "reviews_asc", "reviews_desc"}}, "Sort field, by ASIN when absent")
+	orderParam        = queryParam("order", &openAPISchema{Type: "string", Enum: []string{"asc", "desc"}}, "Direction of a sort field; ascending for price and descending otherwise when absent")
+	currencyParam     = queryParam("currency", stringSchema, "ISO 4217 code to convert prices to, from those configured in EXCHANGE_RATES")
+)
+
+// filterParams are the parameters read by parseProductFilter.
+var filterParams = []openAPIParameter{
+	queryParam("has_image", booleanSchema, "Only products with an image"),
+	queryParam("minPrice", numberSchema, "Only products priced at least this much"),
+	queryParam("maxPrice", numberSchema, "Only products priced at most this much"),
+	queryParam("minStars", numberSchema, "Only products rated at least this many stars, 0 to 5"),
+}
+
+func params(groups ...[]openAPIParameter) []openAPIParameter {
+	var all []openAPIParameter
+	for _, group := range groups {
+		all = append(all, group...)
+	}
+	return all
+}
+
+// Body and response shorthands.
+
+func jsonContent(schema *openAPISchema) map[string]openAPIMediaType {
+	return map[string]openAPIMediaType{"application/json": {Schema: schema}}
+}
+
+func jsonBody(schema *openAPISchema) *openAPIRequestBody {
+	return &openAPIRequestBody{Required: true, Content: jsonContent(schema)}
+}
+
+// responses builds the responses of an operation: a success response with the given status,
+// description and optional JSON schema, followed by the given error statuses.
+func responses(status int, description string, schema *openAPISchema, errorStatuses ...int) map[string]openAPIResponse {
+	all := map[string]openAPIResponse{
+		strconv.Itoa(status): {Description: description},
+		"500":                {Description: "Internal server error", Content: jsonContent(ref("Error"))},
+	}
+	if schema != nil {
+		all[strconv.Itoa(status)] = openAPIResponse{Description: description, Content: jsonContent(schema)}
+	}
+	for _, status := range errorStatuses {
+		all[strconv.Itoa(status)] = openAPIResponse{Description: http.StatusText(status), Content: jsonContent(ref("Error"))}
+	}
+	return all
+}
+
+// withResponse adds or replaces one response of an operation's responses.
+func withResponse(all map[string]openAPIResponse, status int, description string, schema *openAPISchema) map[string]openAPIResponse {
+	all[strconv.Itoa(status)] = openAPIResponse{Description: description, Content: jsonContent(schema)}
+	return all
+}
+
+var apiKeySecurity = []map[string][]string{{"apiKey": {}}}
+
+// openAPISpec describes every route registered in main. Keep it in sync with the handlers.
+func openAPISpec() openAPIDocument {
+	paths := map[string]map[string]openAPIOperation{
+		"/healthz": {"get": {
+			Summary:   "Report that the process is serving requests",
+			Responses: responses(http.StatusOK, "Alive", ref("Readiness")),
+		}},
+		"/readyz": {"get": {
+			Summary: "Report whether the database is reachable and fully migrated",
+			Responses: withResponse(responses(http.StatusOK, "Ready", ref("Readiness")),
+				http.StatusServiceUnavailable, "Database unreachable or migrations pending", ref("Readiness")),
+		}},
+		"/categories": {
+			"get": {
+				Summary: "List all categories",
+				Parameters: []openAPIParameter{
+					queryParam("sort", &openAPISchema{Type: "string", Enum: []string{"name", "name_asc", "name_desc"}}, "Sort order"),
+					queryParam("withCounts", booleanSchema, "Include the number of products in each category"),
+				},
+				Responses: responses(http.StatusOK, "Categories, with their product counts when withCounts=true",
+					&openAPISchema{OneOf: []*openAPISchema{arrayOf(ref("Category")), arrayOf(ref("CategoryWithCount"))}}, http.StatusBadRequest),
+			},
+			"post": {
+				Summary:     "Create a category ahead of stocking it",
+				RequestBody: jsonBody(ref("CreateCategoryRequest")),
+				Responses:   responses(http.StatusCreated, "Category created", ref("CreateCategoryRequest"), http.StatusBadRequest, http.StatusUnauthorized, http.StatusConflict),
+				Security:    apiKeySecurity,
+			},
+		},
+		"/categories/tree": {"get": {
+			Summary:   "List the categories arranged under their parent categories",
+			Responses: responses(http.StatusOK, "Category tree", arrayOf(ref("CategoryNode"))),
+		}},
+		"/categories/{category}": {
+			"get": {
+				Summary: "List a page of the products in a category",
+				Parameters: params([]openAPIParameter{
+					pathParam("category"),
+					sortParam, orderParam,
+					limitParam(20, 100), offsetParam,
+					queryParam("cursor", stringSchema, "nextCursor of the previous page; only with the default sort and no offset"),
+					includeParam, formatPricesParam, localeParam, currencyParam,
+				}, filterParams),
+				Responses: responses(http.StatusOK, "Products", ref("ProductPage"), http.StatusBadRequest, http.StatusNotFound),
+			},
+			"delete": {
+				Summary:    "Delete an empty category",
+				Parameters: []openAPIParameter{pathParam("category")},
+				Responses:  responses(http.StatusNoContent, "Category deleted", nil, http.StatusUnauthorized, http.StatusNotFound, http.StatusConflict),
+				Security:   apiKeySecurity,
+			},
+		},
+		"/categories/{category}/stats": {"get": {
+			Summary:    "Get aggregate figures for the products of a category",
+			Parameters: []openAPIParameter{pathParam("category")},
+			Responses:  responses(http.StatusOK, "Category statistics", ref("CategoryStats"), http.StatusBadRequest, http.StatusNotFound),
+		}},
+		"/products": {
+			"get": {
+				Summary: "List a page of the products in any of several categories",
+				Parameters: params([]openAPIParameter{
+					{Name: "categories", In: "query", Required: true, Schema: stringSchema, Description: "Comma-separated category names, at most " + strconv.Itoa(maxCategoriesPerRequest)},
+					sortParam, orderParam,
+					limitParam(20, 100), offsetParam,
+					includeParam, formatPricesParam, localeParam, currencyParam,
+				}, filterParams),
+				Responses: responses(http.StatusOK, "Products", ref("ProductPage"), http.StatusBadRequest),
+			},
+			"post": {
+				Summary:     "Add a product to the catalogue with its initial stock",
+				RequestBody: jsonBody(ref("ProductInput")),
+				Responses: withResponse(responses(http.StatusCreated, "Product created", ref("Product"), http.StatusUnauthorized, http.StatusConflict),
+					http.StatusBadRequest, "Invalid fields", ref("ValidationError")),
+				Security: apiKeySecurity,
+			},
+		},
+		"/products/search": {"get": {
+			Summary: "Search product titles and categories with full-text search, best match first",
+			Parameters: params([]openAPIParameter{
+				{Name: "q", In: "query", Required: true, Schema: stringSchema, Description: "Web search syntax: words, \"phrases\", or, -excluded"},
+				queryParam("category", stringSchema, "Only search this category"),
+				limitParam(20, 100), offsetParam, includeParam, formatPricesParam, localeParam, currencyParam,
+			}, filterParams),
+			Responses: responses(http.StatusOK, "Matching products", arrayOf(ref("SearchResult")), http.StatusBadRequest),
+		}},
+		"/products/new": {"get": {
+			Summary:    "List the newest products, leaving out soft-deleted ones",
+			Parameters: params([]openAPIParameter{limitParam(20, 100), offsetParam, formatPricesParam, localeParam, currencyParam}, filterParams),
+			Responses:  responses(http.StatusOK, "Products", ref("ProductPage"), http.StatusBadRequest),
+		}},
+		"/products/sample": {"get": {
+			Summary: "Get a stable sample of products for an experiment",
+			Parameters: []openAPIParameter{
+				{Name: "seed", In: "query", Required: true, Schema: stringSchema},
+				{Name: "fraction", In: "query", Required: true, Schema: &openAPISchema{Type: "number", Minimum: bound(0), Maximum: bound(1)}},
+				limitParam(20, 100), formatPricesParam, localeParam, currencyParam,
+			},
+			Responses: responses(http.StatusOK, "Products", arrayOf(ref("Product")), http.StatusBadRequest),
+		}},
+		"/best-sellers": {"get": {
+			Summary:    "List the best-selling products, most bought in the last month first",
+			Parameters: []openAPIParameter{limitParam(10, 50), formatPricesParam, localeParam, currencyParam},
+			Responses:  responses(http.StatusOK, "Products", arrayOf(ref("Product")), http.StatusBadRequest),
+		}},
+		"/products/by-categories": {"post": {
+			Summary:     "Get a few products from each of several categories",
+			RequestBody: jsonBody(ref("ProductsByCategoriesRequest")),
+			Responses:   responses(http.StatusOK, "Products keyed by category", mapOf(arrayOf(ref("Product"))), http.StatusBadRequest),
+		}},
+		"/products/{asin}": {
+			"get": {
+				Summary: "Get a single product",
+				Parameters: []openAPIParameter{
+					pathParam("asin"),
+					queryParam("user-id", stringSchema, "Record the view for this user's recently viewed products"),
+					formatPricesParam, localeParam, currencyParam,
+				},
+				Responses: responses(http.StatusOK, "Product", ref("Product"), http.StatusNotFound),
+			},
+			"put": {
+				Summary:     "Update a product's details",
+				Parameters:  []openAPIParameter{pathParam("asin")},
+				RequestBody: jsonBody(ref("ProductInput")),
+				Responses: withResponse(responses(http.StatusOK, "Product updated", ref("Product"), http.StatusUnauthorized, http.StatusNotFound),
+					http.StatusBadRequest, "Invalid fields", ref("ValidationError")),
+				Security: apiKeySecurity,
+			},
+		},
+		"/products/{asin}/qr": {"get": {
+			Summary: "Get a PNG QR code linking to a product",
+			Parameters: []openAPIParameter{
+				pathParam("asin"),
+				queryParam("size", &openAPISchema{Type: "integer", Default: 256, Minimum: bound(64), Maximum: bound(1024)}, "Image size in pixels"),
+			},
+			Responses: func() map[string]openAPIResponse {
+				all := responses(http.StatusOK, "QR code", nil, http.StatusBadRequest, http.StatusNotFound)
+				all["200"] = openAPIResponse{Description: "QR code", Content: map[string]openAPIMediaType{"image/png": {Schema: &openAPISchema{Type: "string", Format: "binary"}}}}
+				return all
+			}(),
+		}},
+		"/products/{asin}/bought-together": {"get": {
+			Summary:    "List products frequently bought together with a product",
+			Parameters: []openAPIParameter{pathParam("asin"), limitParam(10, 50), formatPricesParam, localeParam, currencyParam},
+			Responses:  responses(http.StatusOK, "Products", arrayOf(ref("Product")), http.StatusBadRequest),
+		}},
+		"/users/{userID}/recently-viewed": {"get": {
+			Summary:    "List the products a user viewed most recently",
+			Parameters: []openAPIParameter{pathParam("userID"), limitParam(10, maxViewsPerUser), formatPricesParam, localeParam, currencyParam},
+			Responses:  responses(http.StatusOK, "Products", arrayOf(ref("Product")), http.StatusBadRequest),
+		}},
+		"/search": {"get": {
+			Summary: "Search products by title",
+			Parameters: params([]openAPIParameter{
+				{Name: "q", In: "query", Required: true, Schema: stringSchema},
+				queryParam("rank", &openAPISchema{Type: "string", Enum: []string{"relevance", "popularity", "blended"}}, "Ranking"),
+				limitParam(20, 100), includeParam, formatPricesParam, localeParam, currencyParam,
+			}, filterParams),
+			Responses: responses(http.StatusOK, "Matching products", arrayOf(ref("SearchResult")), http.StatusBadRequest),
+		}},
+		"/baskets/{basketID}": {"get": {
+			Summary: "Get the contents of one of a user's baskets, with the total",
+			Parameters: []openAPIParameter{
+				pathParam("basketID"),
+				{Name: "user-id", In: "query", Required: true, Schema: stringSchema},
+			},
+			Responses: responses(http.StatusOK, "Basket, with its version in the ETag header", ref("Basket"), http.StatusBadRequest, http.StatusNotFound),
+		}},
+		"/baskets/{basketID}/items/{asin}": {
+			"patch": {
+				Summary: "Change the number of units of a product in a user's basket; 0 removes it",
+				Parameters: []openAPIParameter{
+					pathParam("basketID"), pathParam("asin"),
+					{Name: "user-id", In: "query", Required: true, Schema: stringSchema},
+					ifMatchParam,
+				},
+				RequestBody: jsonBody(ref("UpdateBasketItemRequest")),
+				Responses: withResponse(responses(http.StatusOK, "Updated basket, with its version in the ETag header", ref("Basket"), http.StatusBadRequest, http.StatusNotFound),
+					http.StatusConflict, "Not enough stock for the extra units, or stale If-Match", ref("StockError")),
+			},
+			"delete": {
+				Summary: "Remove a product from a user's basket and return its units to stock",
+				Parameters: []openAPIParameter{
+					pathParam("basketID"), pathParam("asin"),
+					{Name: "user-id", In: "query", Required: true, Schema: stringSchema},
+					ifMatchParam,
+				},
+				Responses: responses(http.StatusNoContent, "Removed, with the basket's new version in the ETag header", nil, http.StatusBadRequest, http.StatusNotFound, http.StatusConflict),
+			},
+		},
+		"/basket/{basketID}": {"get": {
+			Summary:    "Get the contents of a basket",
+			Parameters: []openAPIParameter{pathParam("basketID")},
+			Responses:  responses(http.StatusOK, "Basket, with its version in the ETag header", ref("Basket")),
+		}},
+		"/basket/{basketID}/weight": {"get": {
+			Summary:    "Estimate the shipping weight of a basket",
+			Parameters: []openAPIParameter{pathParam("basketID")},
+			Responses:  responses(http.StatusOK, "Basket weight", ref("BasketWeight")),
+		}},
+		"/basket/{basketID}/can-checkout": {"get": {
+			Summary:    "Check whether a basket is ready for checkout",
+			Parameters: []openAPIParameter{pathParam("basketID")},
+			Responses:  responses(http.StatusOK, "Checkout readiness", ref("CheckoutReadiness")),
+		}},
+		"/basket/{basketID}/reserve-bundle": {"post": {
+			Summary:     "Add a bundle of products to a basket all at once",
+			Parameters:  []openAPIParameter{pathParam("basketID"), ifMatchParam},
+			RequestBody: jsonBody(ref("ReserveBundleRequest")),
+			Responses: withResponse(responses(http.StatusCreated, "Bundle added to basket", nil, http.StatusBadRequest),
+				http.StatusConflict, "Items out of stock or stale basket", ref("BundleError")),
+		}},
+		"/users/{userID}/orders": {"get": {
+			Summary:    "List a user's past orders, most recent first",
+			Parameters: []openAPIParameter{pathParam("userID")},
+			Responses:  responses(http.StatusOK, "Orders", arrayOf(ref("Order"))),
+		}},
+		"/orders/{orderID}": {"get": {
+			Summary: "Get one of a user's orders with the prices paid",
+			Parameters: []openAPIParameter{
+				pathParam("orderID"),
+				{Name: "user-id", In: "query", Required: true, Schema: stringSchema},
+			},
+			Responses: responses(http.StatusOK, "Order", ref("Order"), http.StatusBadRequest, http.StatusNotFound),
+		}},
+		"/users/{userID}/orders/{basketID}/cancel": {"post": {
+			Summary:    "Cancel a checked-out order and put its items back in stock",
+			Parameters: []openAPIParameter{pathParam("userID"), pathParam("basketID")},
+			Responses:  responses(http.StatusOK, "Order cancelled", nil, http.StatusNotFound, http.StatusConflict),
+		}},
+		"/add-item-to-basket": {"post": {
+			Summary:     "Add an item to the basket",
+			Parameters:  []openAPIParameter{ifMatchParam},
+			RequestBody: jsonBody(ref("AddItemToBasketRequest")),
+			Responses: withResponse(responses(http.StatusCreated, "Item added to basket", nil, http.StatusBadRequest, http.StatusNotFound),
+				http.StatusConflict, "Out of stock or stale basket", ref("StockError")),
+		}},
+		"/remove-item-from-basket": {"post": {
+			Summary:     "Remove an item from the basket",
+			Parameters:  []openAPIParameter{ifMatchParam},
+			RequestBody: jsonBody(ref("AddItemToBasketRequest")),
+			Responses:   responses(http.StatusOK, "Item removed from basket", nil, http.StatusBadRequest, http.StatusNotFound, http.StatusConflict),
+		}},
+		"/clear-basket": {"post": {
+			Summary:     "Remove every item from a basket and return them to stock",
+			Parameters:  []openAPIParameter{ifMatchParam},
+			RequestBody: jsonBody(ref("CheckoutBasketRequest")),
+			Responses: responses(http.StatusOK, "Number of units removed",
+				object(map[string]*openAPISchema{"basket-id": stringSchema, "removed": integerSchema}), http.StatusBadRequest, http.StatusConflict),
+		}},
+		"/transfer-basket": {"post": {
+			Summary:     "Move a guest's basket to the account they logged in to",
+			Parameters:  []openAPIParameter{ifMatchParam},
+			RequestBody: jsonBody(ref("TransferBasketRequest")),
+			Responses: responses(http.StatusOK, "Number of units moved",
+				object(map[string]*openAPISchema{"basket-id": stringSchema, "transferred": integerSchema}), http.StatusBadRequest, http.StatusNotFound, http.StatusConflict),
+		}},
+		"/register": {"post": {
+			Summary:     "Create a user account and return a token for it",
+			RequestBody: jsonBody(ref("Credentials")),
+			Responses:   responses(http.StatusCreated, "Account created", ref("AuthResponse"), http.StatusBadRequest, http.StatusConflict),
+		}},
+		"/login": {"post": {
+			Summary:     "Exchange an email and password for a token",
+			RequestBody: jsonBody(ref("Credentials")),
+			Responses:   responses(http.StatusOK, "Logged in", ref("AuthResponse"), http.StatusBadRequest, http.StatusUnauthorized),
+		}},
+		"/add-items-to-basket": {"post": {
+			Summary:     "Add several items to a basket at once; either all are added or none",
+			Parameters:  []openAPIParameter{ifMatchParam},
+			RequestBody: jsonBody(ref("AddItemsToBasketRequest")),
+			Responses: withResponse(responses(http.StatusCreated, "All items added", ref("AddItemsToBasketResult"), http.StatusBadRequest),
+				http.StatusConflict, "Nothing added because items are missing or out of stock", ref("AddItemsToBasketResult")),
+		}},
+		"/checkout-basket": {"post": {
+			Summary: "Checkout a basket",
+			Parameters: []openAPIParameter{
+				ifMatchParam,
+				{Name: "Idempotency-Key", In: "header", Schema: stringSchema, Description: "Replays the original result when the same user repeats the key"},
+			},
+			RequestBody: jsonBody(ref("CheckoutBasketRequest")),
+			Responses:   responses(http.StatusOK, "Basket checked out and order created", ref("CheckoutResult"), http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity),
+		}},
+		"/admin/categories/{category}/zero-stock": {"post": {
+			Summary:    "Mark every product in a category as out of stock",
+			Parameters: []openAPIParameter{pathParam("category")},
+			Responses: responses(http.StatusOK, "Number of products changed",
+				object(map[string]*openAPISchema{"category": stringSchema, "affected": integerSchema}), http.StatusBadRequest, http.StatusUnauthorized),
+			Security: apiKeySecurity,
+		}},
+		"/products/{asin}/inventory": {"post": {
+			Summary:     "Restock or correct a product's stock count",
+			Parameters:  []openAPIParameter{pathParam("asin")},
+			RequestBody: jsonBody(ref("InventoryAdjustment")),
+			Responses: responses(http.StatusOK, "New stock count",
+				object(map[string]*openAPISchema{"asin": stringSchema, "count": integerSchema}), http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound, http.StatusConflict),
+			Security: apiKeySecurity,
+		}},
+		"/admin/products/reassign-category": {"post": {
+			Summary:     "Move a set of products to another category",
+			RequestBody: jsonBody(ref("ReassignCategoryRequest")),
+			Responses: responses(http.StatusOK, "Products moved",
+				object(map[string]*openAPISchema{"updated": integerSchema, "missing": arrayOf(stringSchema)}), http.StatusBadRequest, http.StatusUnauthorized),
+			Security: apiKeySecurity,
+		}},
+		"/admin/products/low-stock": {"get": {
+			Summary: "List products that are running out of stock",
+			Parameters: []openAPIParameter{
+				queryParam("threshold", integerSchema, "Stock count at or below which a product is listed"),
+				limitParam(100, 500),
+			},
+			Responses: responses(http.StatusOK, "Products", arrayOf(ref("LowStockProduct")), http.StatusBadRequest, http.StatusUnauthorized),
+			Security:  apiKeySecurity,
+		}},
+		"/reports/low-stock": {"get": {
+			Summary: "List every product at or below a stock threshold, including those out of stock",
+			Parameters: []openAPIParameter{
+				queryParam("threshold", &openAPISchema{Type: "integer", Default: 5}, "Stock count at or below which a product is listed"),
+				limitParam(1000, 10000),
+			},
+			Responses: responses(http.StatusOK, "Products", arrayOf(ref("LowStockProduct")), http.StatusBadRequest, http.StatusUnauthorized),
+			Security:  apiKeySecurity,
+		}},
+		"/admin/metrics": {"get": {
+			Summary:    "Read the in-memory request metrics",
+			Parameters: []openAPIParameter{queryParam("reset", booleanSchema, "Clear the counters after reading them")},
+			Responses:  responses(http.StatusOK, "Request metrics", ref("MetricsSnapshot"), http.StatusUnauthorized),
+			Security:   apiKeySecurity,
+		}},
+		"/admin/top-spenders": {"get": {
+			Summary:    "List the users who have spent the most",
+			Parameters: []openAPIParameter{limitParam(20, 100)},
+			Responses:  responses(http.StatusOK, "Users", arrayOf(ref("UserSpend")), http.StatusBadRequest, http.StatusUnauthorized),
+			Security:   apiKeySecurity,
+		}},
+		"/metrics": {"get": {
+			Summary: "Get request, database and basket metrics in the Prometheus text format",
+			Responses: func() map[string]openAPIResponse {
+				all := responses(http.StatusOK, "Metrics", nil)
+				all["200"] = openAPIResponse{Description: "Metrics", Content: map[string]openAPIMediaType{"text/plain": {Schema: stringSchema}}}
+				return all
+			}(),
+		}},
+		"/openapi.json": {"get": {
+			Summary:   "Get this OpenAPI document",
+			Responses: responses(http.StatusOK, "OpenAPI document", &openAPISchema{Type: "object"}),
+		}},
+	}
+
+	// Every write but the publicWrites needs the API key, see requireAPIKeyForWrites
+	for path, operations := range paths {
+		for method, operation := range operations {
+			if method != "get" && !publicWrites[path] {
+				operation.Security = apiKeySecurity
+				operations[method] = operation
+			}
+		}
+	}
+
+	// Basket and order routes take a bearer token, which registered users must send, see
+	// authorizeUser; guests may leave it out
+	for _, path := range []string{
+		"/baskets/{basketID}", "/baskets/{basketID}/items/{asin}", "/basket/{basketID}", "/basket/{basketID}/weight",
+		"/basket/{basketID}/can-checkout", "/basket/{basketID}/reserve-bundle", "/users/{userID}/orders",
+		"/orders/{orderID}", "/users/{userID}/orders/{basketID}/cancel", "/add-item-to-basket",
+		"/remove-item-from-basket", "/clear-basket", "/transfer-basket", "/add-items-to-basket", "/checkout-basket",
+	} {
+		for method, operation := range paths[path] {
+			withToken, withoutToken := map[string][]string{"bearerAuth": {}}, map[string][]string{}
+			if method != "get" {
+				withToken["apiKey"], withoutToken["apiKey"] = []string{}, []string{}
+			}
+			operation.Security = []map[string][]string{withToken, withoutToken}
+			operation.Responses = withResponse(operation.Responses, http.StatusUnauthorized, "Missing or invalid bearer token", ref("Error"))
+			operation.Responses = withResponse(operation.Responses, http.StatusForbidden, "Token belongs to another user", ref("Error"))
+			paths[path][method] = operation
+		}
+	}
+
+	productProperties := map[string]*openAPISchema{
+		"asin":              stringSchema,
+		"title":             stringSchema,
+		"imgUrl":            stringSchema,
+		"productUrl":        stringSchema,
+		"stars":             &openAPISchema{Type: "number", Minimum: bound(0), Maximum: bound(5)},
+		"reviews":           integerSchema,
+		"price":             numberSchema,
+		"isBestSeller":      booleanSchema,
+		"boughtInLastMonth": integerSchema,
+		"categoryName":      stringSchema,
+		"available":         &openAPISchema{Type: "integer", Description: "Available units, only with include=stock"},
+		"price_display":     &openAPISchema{Type: "string", Description: "Formatted price, only with format_prices=true"},
+		"currency":          &openAPISchema{Type: "string", Description: "Currency the price was converted to, only with currency"},
+	}
+	productWith := func(properties map[string]*openAPISchema, required ...string) *openAPISchema {
+		return &openAPISchema{AllOf: []*openAPISchema{ref("Product"), object(properties, required...)}}
+	}
+	stockError := object(map[string]*openAPISchema{"asin": stringSchema, "requested": integerSchema, "available": integerSchema})
+
+	schemas := map[string]*openAPISchema{
+		"Error": object(map[string]*openAPISchema{"error": stringSchema, "status": integerSchema}, "error", "status"),
+		"StockError": object(map[string]*openAPISchema{
+			"error": stringSchema, "status": integerSchema, "asin": stringSchema, "requested": integerSchema, "available": integerSchema,
+		}),
+		"BundleError": object(map[string]*openAPISchema{
+			"error": stringSchema, "status": integerSchema, "shortages": arrayOf(stockError), "missing": arrayOf(stringSchema),
+		}),
+		"ValidationError": object(map[string]*openAPISchema{
+			"error": stringSchema, "status": integerSchema, "fields": mapOf(stringSchema),
+		}),
+		"Readiness": object(map[string]*openAPISchema{
+			"status":            {Type: "string", Enum: []string{"ok", "unavailable"}},
+			"database":          {Type: "string", Enum: []string{"ok", "unreachable"}},
+			"pendingMigrations": arrayOf(stringSchema),
+		}, "status"),
+		"Product":  object(productProperties, "asin", "title", "price", "categoryName"),
+		"Category": object(map[string]*openAPISchema{"name": stringSchema}, "name"),
+		"CategoryStats": object(map[string]*openAPISchema{
+			"category":        stringSchema,
+			"productCount":    integerSchema,
+			"averagePrice":    numberSchema,
+			"averageStars":    numberSchema,
+			"totalReviews":    integerSchema,
+			"bestSellerCount": integerSchema,
+			"unitsInStock":    integerSchema,
+		}),
+		"CategoryWithCount": object(map[string]*openAPISchema{"name": stringSchema, "count": integerSchema}, "name", "count"),
+		"CategoryNode": object(map[string]*openAPISchema{
+			"name":              stringSchema,
+			"productCount":      integerSchema,
+			"totalProductCount": integerSchema,
+			"children":          arrayOf(ref("CategoryNode")),
+		}),
+		"ProductPage": object(map[string]*openAPISchema{
+			"products": arrayOf(ref("Product")), "limit": integerSchema, "offset": integerSchema, "total": integerSchema,
+			"nextCursor": &openAPISchema{Type: "string", Description: "Cursor of the next page when ordered by ASIN"},
+		}),
+		"SearchResult":    productWith(map[string]*openAPISchema{"score": numberSchema}),
+		"BasketLine":      productWith(map[string]*openAPISchema{"quantity": integerSchema}),
+		"LowStockProduct": productWith(map[string]*openAPISchema{"count": integerSchema}),
+		"Basket": object(map[string]*openAPISchema{
+			"basketId":     stringSchema,
+			"userId":       stringSchema,
+			"isCheckedOut": booleanSchema,
+			"items":        arrayOf(ref("BasketLine")),
+			"total":        numberSchema,
+			"version":      integerSchema,
+		}),
+		"BasketWeight": object(map[string]*openAPISchema{
+			"basketId": stringSchema, "weight": numberSchema, "itemsMissingWeight": integerSchema,
+		}),
+		"Order": object(map[string]*openAPISchema{
+			"orderId":     integerSchema,
+			"userId":      stringSchema,
+			"basketId":    stringSchema,
+			"status":      {Type: "string", Enum: []string{"placed", "cancelled"}},
+			"total":       numberSchema,
+			"createdAt":   {Type: "string", Format: "date-time"},
+			"cancelledAt": {Type: "string", Format: "date-time", Nullable: true},
+			"items": arrayOf(object(map[string]*openAPISchema{
+				"productId": stringSchema,
+				"title":     stringSchema,
+				"price":     numberSchema,
+				"quantity":  integerSchema,
+			})),
+		}),
+		"CheckoutReadiness": object(map[string]*openAPISchema{
+			"basketId":    stringSchema,
+			"canCheckout": booleanSchema,
+			"reasons": arrayOf(object(map[string]*openAPISchema{
+				"code":  {Type: "string", Enum: []string{"already_checked_out", "empty", "out_of_stock"}},
+				"asins": arrayOf(stringSchema),
+			})),
+		}),
+		"UserSpend": object(map[string]*openAPISchema{
+			"userId": stringSchema, "totalSpend": numberSchema, "orderCount": integerSchema, "largestOrder": numberSchema,
+		}),
+		"MetricsSnapshot": object(map[string]*openAPISchema{
+			"requests": integerSchema,
+			"errors":   integerSchema,
+			"routes": arrayOf(object(map[string]*openAPISchema{
+				"method": stringSchema, "route": stringSchema, "status": integerSchema, "count": integerSchema, "avgLatencyMs": numberSchema,
+			})),
+		}),
+		"AddItemToBasketRequest": object(map[string]*openAPISchema{
+			"product-id": stringSchema,
+			"user-id":    stringSchema,
+			"basket-id":  stringSchema,
+			"quantity":   {Type: "integer", Default: 1, Description: "Only used when adding items"},
+		}, "product-id", "user-id", "basket-id"),
+		"AddItemsToBasketRequest": object(map[string]*openAPISchema{
+			"user-id":   stringSchema,
+			"basket-id": stringSchema,
+			"items":     arrayOf(object(map[string]*openAPISchema{"product-id": stringSchema, "quantity": {Type: "integer", Default: 1}}, "product-id")),
+		}, "user-id", "basket-id", "items"),
+		"AddItemsToBasketResult": object(map[string]*openAPISchema{
+			"basketId": stringSchema,
+			"added":    booleanSchema,
+			"items": arrayOf(object(map[string]*openAPISchema{
+				"product-id": stringSchema,
+				"quantity":   integerSchema,
+				"status":     {Type: "string", Enum: []string{"added", "out_of_stock", "not_found", "rolled_back"}},
+				"available":  integerSchema,
+			})),
+		}),
+		"CheckoutBasketRequest": object(map[string]*openAPISchema{
+			"user-id": stringSchema, "basket-id": stringSchema,
+		}, "user-id", "basket-id"),
+		"UpdateBasketItemRequest": object(map[string]*openAPISchema{"quantity": integerSchema}, "quantity"),
+		"CheckoutResult": object(map[string]*openAPISchema{
+			"orderId": integerSchema, "basketId": stringSchema, "total": numberSchema,
+		}, "orderId", "basketId", "total"),
+		"TransferBasketRequest": object(map[string]*openAPISchema{
+			"basket-id": stringSchema, "from-user-id": stringSchema, "to-user-id": stringSchema,
+		}, "basket-id", "from-user-id", "to-user-id"),
+		"Credentials": object(map[string]*openAPISchema{
+			"email":    {Type: "string", Format: "email"},
+			"password": {Type: "string", Description: "8 to 72 bytes"},
+		}, "email", "password"),
+		"AuthResponse": object(map[string]*openAPISchema{
+			"userId":    stringSchema,
+			"token":     {Type: "string", Description: "Send as \"Authorization: Bearer <token>\""},
+			"expiresAt": {Type: "string", Format: "date-time"},
+		}, "userId", "token", "expiresAt"),
+		"ReserveBundleRequest": object(map[string]*openAPISchema{
+			"user-id": stringSchema,
+			"items":   arrayOf(object(map[string]*openAPISchema{"product-id": stringSchema, "quantity": integerSchema}, "product-id", "quantity")),
+		}, "user-id", "items"),
+		"ProductsByCategoriesRequest": object(map[string]*openAPISchema{
+			"categories":   arrayOf(stringSchema),
+			"per_category": {Type: "integer", Default: 5},
+		}, "categories"),
+		"ReassignCategoryRequest": object(map[string]*openAPISchema{
+			"asins": arrayOf(stringSchema), "category": stringSchema,
+		}, "asins", "category"),
+		"CreateCategoryRequest": object(map[string]*openAPISchema{
+			"name": stringSchema, "parentCategory": stringSchema,
+		}, "name"),
+		"ProductInput": productWith(map[string]*openAPISchema{
+			"count": {Type: "integer", Description: "Initial stock, only used when creating a product"},
+		}),
+		"InventoryAdjustment": object(map[string]*openAPISchema{
+			"delta": {Type: "integer", Description: "Change the stock by this many units"},
+			"count": {Type: "integer", Description: "Set the stock to this many units"},
+		}),
+	}
+
+	return openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "Product catalogue and basket API", Version: "1.0.0"},
+		Paths:   paths,
+		Components: openAPIComponents{
+			Schemas: schemas,
+			SecuritySchemes: map[string]openAPISecurityScheme{
+				"apiKey":     {Type: "apiKey", In: "header", Name: "X-API-Key"},
+				"bearerAuth": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+			},
+		},
+	}
+}
+
+// serveOpenAPI returns a handler serving the OpenAPI document, encoded once up front.
+func serveOpenAPI() http.HandlerFunc {
+	spec, err := json.Marshal(openAPISpec())
+	if err != nil {
+		panic(err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// CheckoutResult is the order created by checking out a basket.
+type CheckoutResult struct {
+	OrderID  int64   `json:"orderId"`
+	BasketID string  `json:"basketId"`
+	Total    float64 `json:"total"`
+	// Version is the basket's version after checkout, sent in the ETag header.
+	Version int64 `json:"-"`
+}
+
+// createOrder records the user's open basket items as a new order as part of tx, with the
+// current title and price of each product, and returns the order's ID and total. Items whose
+// product no longer exists are skipped; checkoutBasket rejects such baskets beforehand.
+func createOrder(ctx context.Context, tx *sql.Tx, userID, basketID string) (int64, float64, error) {
+	var orderID int64
+	var total float64
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO "Orders" ("UserId", "BasketId", "Total")
+		SELECT $1, $2, COALESCE(SUM(p."price"::float8 * b."Quantity"), 0)
+		FROM "Baskets" b
+		JOIN "Products" p ON p."asin" = b."ProductId"
+		WHERE b."UserId" = $1 AND b."BasketId" = $2 AND b."IsCheckedOut" = false
+		RETURNING "OrderId", "Total"`, userID, basketID).Scan(&orderID, &total)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO "OrderItems" ("OrderId", "ProductId", "Title", "Price", "Quantity")
+		SELECT $3, b."ProductId", p."title", p."price", b."Quantity"
+		FROM "Baskets" b
+		JOIN "Products" p ON p."asin" = b."ProductId"
+		WHERE b."UserId" = $1 AND b."BasketId" = $2 AND b."IsCheckedOut" = false`, userID, basketID, orderID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return orderID, total, nil
+}
+
+// cancelOrders marks the placed orders of the user's basket as cancelled as part of tx.
+func cancelOrders(ctx context.Context, tx *sql.Tx, userID, basketID string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE "Orders" SET "Status" = 'cancelled', "CancelledAt" = now()
+		WHERE "UserId" = $1 AND "BasketId" = $2 AND "Status" = 'placed'`, userID, basketID)
+	return err
+}
+
+// Order is a checked-out basket as it was at the time of purchase.
+type Order struct {
+	OrderID     int64       `json:"orderId"`
+	UserID      string      `json:"userId"`
+	BasketID    string      `json:"basketId"`
+	Status      string      `json:"status"`
+	Total       float64     `json:"total"`
+	CreatedAt   time.Time   `json:"createdAt"`
+	CancelledAt *time.Time  `json:"cancelledAt"`
+	Items       []OrderItem `json:"items"`
+}
+
+// OrderItem is a product of an order with the title and price it had when it was bought.
+type OrderItem struct {
+	ProductID string  `json:"productId"`
+	Title     string  `json:"title"`
+	Price     float32 `json:"price"`
+	Quantity  int     `json:"quantity"`
+}
+
+const orderColumns = `"OrderId", "UserId", "BasketId", "Status", "Total", "CreatedAt", "CancelledAt"`
+
+// getOrders retrieves a user's orders with their items, most recent first.
+func getOrders(ctx context.Context, db *sql.DB, userID string) ([]Order, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+orderColumns+`
+		FROM "Orders"
+		WHERE "UserId" = $1
+		ORDER BY "CreatedAt" DESC, "OrderId" DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := make([]Order, 0)
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err = addOrderItems(ctx, db, orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// getOrder retrieves one of a user's orders with its items. It returns ErrOrderNotFound for
+// an unknown order or one of another user.
+func getOrder(ctx context.Context, db *sql.DB, userID string, orderID int64) (*Order, error) {
+	row := db.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM "Orders" WHERE "OrderId" = $1 AND "UserId" = $2`, orderID, userID)
+	order, err := scanOrder(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrOrderNotFound
+		}
+		return nil, err
+	}
+
+	orders := []Order{order}
+	if err = addOrderItems(ctx, db, orders); err != nil {
+		return nil, err
+	}
+	return &orders[0], nil
+}
+
+// scanOrder scans the orderColumns of a row, without the items.
+func scanOrder(row interface{ Scan(...interface{}) error }) (Order, error) {
+	var order Order
+	var cancelledAt sql.NullTime
+	err := row.Scan(&order.OrderID, &order.UserID, &order.BasketID, &order.Status, &order.Total, &order.CreatedAt, &cancelledAt)
+	if err != nil {
+		return Order{}, err
+	}
+	if cancelledAt.Valid {
+		order.CancelledAt = &cancelledAt.Time
+	}
+	order.Items = make([]OrderItem, 0)
+	return order, nil
+}
+
+// addOrderItems loads the items of every order in one query.
+func addOrderItems(ctx context.Context, db *sql.DB, orders []Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	index := make(map[int64]int, len(orders))
+	ids := make([]int64, len(orders))
+	for i, order := range orders {
+		index[order.OrderID] = i
+		ids[i] = order.OrderID
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT "OrderId", "ProductId", "Title", "Price", "Quantity"
+		FROM "OrderItems"
+		WHERE "OrderId" = ANY($1)
+		ORDER BY "OrderId", "ProductId"`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID int64
+		var item OrderItem
+		if err := rows.Scan(&orderID, &item.ProductID, &item.Title, &item.Price, &item.Quantity); err != nil {
+			return err
+		}
+		order := &orders[index[orderID]]
+		order.Items = append(order.Items, item)
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// priceCurrency is the currency product prices are stored in. It is set from the
+// PRICE_CURRENCY setting at startup.
+var priceCurrency = currency.USD
+
+// exchangeRates holds how many units of each supported currency one unit of priceCurrency is
+// worth. It is set from the EXCHANGE_RATES setting at startup.
+var exchangeRates = map[currency.Unit]float64{}
+
+// parseExchangeRates parses a comma-separated list of CODE=rate pairs such as
+// "EUR=0.92,GBP=0.79".
+func parseExchangeRates(s string) (map[currency.Unit]float64, error) {
+	rates := make(map[currency.Unit]float64)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		code, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not CODE=rate", pair)
+		}
+		unit, err := currency.ParseISO(strings.TrimSpace(code))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", code, err)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || !(rate > 0) || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("%q is not a positive rate", value)
+		}
+		rates[unit] = rate
+	}
+	return rates, nil
+}
+
+// parseCurrency returns the currency requested with ?currency=EUR and its exchange rate.
+// It returns ok false when no currency was requested, and ErrUnsupportedCurrency for a code
+// that is neither priceCurrency nor in exchangeRates.
+func parseCurrency(r *http.Request) (unit currency.Unit, rate float64, ok bool, err error) {
+	v := r.URL.Query().Get("currency")
+	if v == "" {
+		return currency.Unit{}, 0, false, nil
+	}
+
+	unit, err = currency.ParseISO(v)
+	if err != nil {
+		return currency.Unit{}, 0, false, ErrUnsupportedCurrency
+	}
+	if unit == priceCurrency {
+		return unit, 1, true, nil
+	}
+	rate, supported := exchangeRates[unit]
+	if !supported {
+		return currency.Unit{}, 0, false, ErrUnsupportedCurrency
+	}
+	return unit, rate, true, nil
+}
+
+// convertPrices converts the prices of the products held by a response value to unit,
+// rounded to cents, and records the currency on each product.
+func convertPrices(v interface{}, unit currency.Unit, rate float64) {
+	eachProduct(v, func(product *Product) {
+		product.Price = float32(math.Round(float64(product.Price)*rate*100) / 100)
+		product.Currency = unit.String()
+	})
+}
+
+// parsePriceFormat returns the printer for ?format_prices=true&locale=..., or nil when price
+// formatting was not requested. The locale defaults to en-US.
+func parsePriceFormat(r *http.Request) (*message.Printer, error) {
+	if r.URL.Query().Get("format_prices") != "true" {
+		return nil, nil
+	}
+
+	locale := r.URL.Query().Get("locale")
+	if locale == "" {
+		locale = "en-US"
+	}
+
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return nil, ErrInvalidLocale
+	}
+
+	return message.NewPrinter(tag), nil
+}
+
+// formatPrice renders the product's price with its currency symbol and the locale's
+// separators, in the currency it was converted to or else in priceCurrency.
+func formatPrice(printer *message.Printer, product *Product) string {
+	unit := priceCurrency
+	if product.Currency != "" {
+		unit = currency.MustParseISO(product.Currency)
+	}
+	return printer.Sprint(currency.Symbol(unit.Amount(float64(product.Price))))
+}
+
+// addPriceDisplay sets PriceDisplay on the products held by a response value. The numeric
+// price stays authoritative; the display string is for presentation only.
+func addPriceDisplay(v interface{}, printer *message.Printer) {
+	eachProduct(v, func(product *Product) {
+		product.PriceDisplay = formatPrice(printer, product)
+	})
+}
+
+// eachProduct calls fn for every product held by a response value.
+func eachProduct(v interface{}, fn func(*Product)) {
+	switch v := v.(type) {
+	case *Product:
+		fn(v)
+	case []Product:
+		for i := range v {
+			fn(&v[i])
+		}
+	case []SearchResult:
+		for i := range v {
+			fn(&v[i].Product)
+		}
+	case ProductPage:
+		eachProduct(v.Products, fn)
+	}
+}
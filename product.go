@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"strings"
+)
+
+// ProductInput is the body of the product create and update requests. Count is the initial
+// stock and is only used when creating a product.
+type ProductInput struct {
+	Product
+	Count int `json:"count"`
+}
+
+// validate normalizes the input and checks every field, returning a *ValidationError
+// listing all invalid fields. The ASIN is only required when creating a product.
+func (in *ProductInput) validate(create bool) error {
+	fields := make(map[string]string)
+
+	in.ASIN = strings.TrimSpace(in.ASIN)
+	in.Title = strings.TrimSpace(in.Title)
+	in.CategoryName = normalizeCategory(in.CategoryName)
+
+	if create && in.ASIN == "" {
+		fields["asin"] = "is required"
+	}
+	if in.Title == "" {
+		fields["title"] = "is required"
+	}
+	if in.CategoryName == "" {
+		fields["categoryName"] = "is required"
+	}
+	if in.Price < 0 {
+		fields["price"] = "must not be negative"
+	}
+	if in.Stars < 0 || in.Stars > 5 {
+		fields["stars"] = "must be between 0 and 5"
+	}
+	if in.Reviews < 0 {
+		fields["reviews"] = "must not be negative"
+	}
+	if in.BoughtInLastMonth < 0 {
+		fields["boughtInLastMonth"] = "must not be negative"
+	}
+	if in.ImgURL != "" && !isHTTPURL(in.ImgURL) {
+		fields["imgUrl"] = "must be an absolute http or https URL"
+	}
+	if in.ProductURL != "" && !isHTTPURL(in.ProductURL) {
+		fields["productUrl"] = "must be an absolute http or https URL"
+	}
+	if create && in.Count < 0 {
+		fields["count"] = "must not be negative"
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// isHTTPURL reports whether s is an absolute http or https URL with a host.
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// createProduct inserts a product together with its ProductCounts row holding count units.
+// It returns ErrProductExists when a product with the same ASIN already exists.
+func createProduct(ctx context.Context, db *sql.DB, product Product, count int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Concurrent creates of the same ASIN wait on each other here, and all but one insert nothing
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO "Products" ("asin", "title", "imgUrl", "productUrl", "stars", "reviews", "price", "isBestSeller", "boughtInLastMonth", "categoryName")
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT ("asin") DO NOTHING`,
+		product.ASIN, product.Title, product.ImgURL, product.ProductURL, product.Stars, product.Reviews,
+		product.Price, product.IsBestSeller, product.BoughtInLastMonth, product.CategoryName)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrProductExists
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO \"ProductCounts\" (\"asin\", \"count\") VALUES ($1, $2)", product.ASIN, count)
+	if err != nil {
+		return err
+	}
+
+	if err = recordStockChange(ctx, tx, product.ASIN, count, count, "product created"); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// updateProduct overwrites the mutable fields of the product with product.ASIN and returns
+// the updated product. It returns sql.ErrNoRows when the product does not exist.
+func updateProduct(ctx context.Context, db *sql.DB, product Product) (*Product, error) {
+	var updated Product
+	err := db.QueryRowContext(ctx, `
+		UPDATE "Products" p
+		SET "title" = $2, "imgUrl" = $3, "productUrl" = $4, "stars" = $5, "reviews" = $6, "price" = $7,
+			"isBestSeller" = $8, "boughtInLastMonth" = $9, "categoryName" = $10
+		WHERE p."asin" = $1
+		RETURNING `+productColumns,
+		product.ASIN, product.Title, product.ImgURL, product.ProductURL, product.Stars, product.Reviews,
+		product.Price, product.IsBestSeller, product.BoughtInLastMonth, product.CategoryName).
+		Scan(updated.scanDest()...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+// adjustInventory changes the product's stock by delta, or sets it to *count when count is
+// not nil, and returns the new count. The ProductCounts row is locked for the transaction so
+// concurrent adjustments and basket changes are not lost. It returns ErrProductNotFound when
+// the product has no ProductCounts row and ErrNegativeStock when the stock would drop below 0.
+func adjustInventory(ctx context.Context, db *sql.DB, asin string, delta int, count *int) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var current int
+	err = tx.QueryRowContext(ctx, "SELECT \"count\" FROM \"ProductCounts\" WHERE \"asin\" = $1 FOR UPDATE", asin).Scan(&current)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrProductNotFound
+		}
+		return 0, err
+	}
+
+	next := current + delta
+	if count != nil {
+		next = *count
+	}
+	if next < 0 {
+		return 0, ErrNegativeStock
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE \"ProductCounts\" SET \"count\" = $2 WHERE \"asin\" = $1", asin, next)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = recordStockChange(ctx, tx, asin, next-current, next, "inventory adjustment"); err != nil {
+		return 0, err
+	}
+
+	return next, tx.Commit()
+}
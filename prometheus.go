@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PrometheusMetrics exports request counters, a request duration histogram, database query
+// durations, the database connection pool stats and basket counters in the Prometheus
+// exposition format.
+type PrometheusMetrics struct {
+	registry   *prometheus.Registry
+	requests   *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	itemsAdded prometheus.Counter
+	checkouts  prometheus.Counter
+}
+
+// NewPrometheusMetrics creates the request and basket metrics and registers them, together
+// with dbQueryDuration and the stats of db's connection pool and the Go runtime, in a registry
+// of their own. db should be opened with instrumentedConnector to report query durations.
+func NewPrometheusMetrics(db *sql.DB) *PrometheusMetrics {
+	p := &PrometheusMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests by method, route template and status code.",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request duration by method and route template.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		itemsAdded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "items_added_to_basket_total",
+			Help: "Units of products added to baskets.",
+		}),
+		checkouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "checkouts_total",
+			Help: "Baskets checked out, not counting replayed idempotent requests.",
+		}),
+	}
+	p.registry.MustRegister(
+		p.requests,
+		p.duration,
+		p.itemsAdded,
+		p.checkouts,
+		dbQueryDuration,
+		collectors.NewDBStatsCollector(db, "postgres"),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return p
+}
+
+// Observe records one request.
+func (p *PrometheusMetrics) Observe(method, route string, status int, duration time.Duration) {
+	p.requests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	p.duration.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+// ItemsAdded counts units added to a basket.
+func (p *PrometheusMetrics) ItemsAdded(units int) {
+	p.itemsAdded.Add(float64(units))
+}
+
+// CheckedOut counts a checkout.
+func (p *PrometheusMetrics) CheckedOut() {
+	p.checkouts.Inc()
+}
+
+// Handler serves the metrics for Prometheus to scrape.
+func (p *PrometheusMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// maxCachedQRCodes bounds the QR code cache; it is emptied when it fills up.
+const maxCachedQRCodes = 1000
+
+// qrKey identifies a QR code by what it encodes, so a product whose URL changes gets a new one.
+type qrKey struct {
+	ProductURL string
+	Size       int
+}
+
+// QRCache holds rendered product QR codes so each one is only generated once.
+type QRCache struct {
+	mu     sync.Mutex
+	images map[qrKey][]byte
+}
+
+func NewQRCache() *QRCache {
+	return &QRCache{images: make(map[qrKey][]byte)}
+}
+
+// Get returns the PNG QR code encoding the product's URL at the given size in pixels.
+func (c *QRCache) Get(product *Product, size int) ([]byte, error) {
+	key := qrKey{ProductURL: product.ProductURL, Size: size}
+
+	c.mu.Lock()
+	png, ok := c.images[key]
+	c.mu.Unlock()
+	if ok {
+		return png, nil
+	}
+
+	png, err := qrcode.Encode(product.ProductURL, qrcode.Medium, size)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if len(c.images) >= maxCachedQRCodes {
+		c.images = make(map[qrKey][]byte)
+	}
+	c.images[key] = png
+	c.mu.Unlock()
+
+	return png, nil
+}
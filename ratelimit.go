@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter is a per-client-IP token bucket rate limiter. Clients that have been idle for
+// longer than idleTimeout are forgotten, so the map of clients does not grow unbounded.
+type RateLimiter struct {
+	limit          rate.Limit
+	burst          int
+	trustForwarded bool
+	idleTimeout    time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*rateClient
+
+	done chan struct{}
+}
+
+// rateClient is the token bucket of one client IP.
+type rateClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewRateLimiter allows each client IP rps requests per second with bursts of up to burst
+// requests. When trustForwarded is set, the client IP is taken from X-Forwarded-For, for
+// deployments behind a reverse proxy.
+func NewRateLimiter(rps float64, burst int, trustForwarded bool, idleTimeout time.Duration) *RateLimiter {
+	rl := &RateLimiter{
+		limit:          rate.Limit(rps),
+		burst:          burst,
+		trustForwarded: trustForwarded,
+		idleTimeout:    idleTimeout,
+		clients:        make(map[string]*rateClient),
+		done:           make(chan struct{}),
+	}
+	go rl.cleanup()
+	return rl
+}
+
+// Close stops the background cleanup of idle clients.
+func (rl *RateLimiter) Close() {
+	close(rl.done)
+}
+
+func (rl *RateLimiter) cleanup() {
+	ticker := time.NewTicker(rl.idleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rl.done:
+			return
+		case now := <-ticker.C:
+			rl.mu.Lock()
+			for ip, client := range rl.clients {
+				if now.Sub(client.lastSeen) > rl.idleTimeout {
+					delete(rl.clients, ip)
+				}
+			}
+			rl.mu.Unlock()
+		}
+	}
+}
+
+// limiter returns the token bucket for ip, creating it on first use.
+func (rl *RateLimiter) limiter(ip string) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	client, ok := rl.clients[ip]
+	if !ok {
+		client = &rateClient{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[ip] = client
+	}
+	client.lastSeen = time.Now()
+	return client.limiter
+}
+
+// clientIP returns the IP the request came from. Behind a trusted proxy that is the last
+// X-Forwarded-For entry, the one the proxy itself appended; earlier entries are supplied by
+// the client and can't be trusted.
+func (rl *RateLimiter) clientIP(r *http.Request) string {
+	if rl.trustForwarded {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			entries := strings.Split(forwarded, ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Middleware responds 429 Too Many Requests, with a Retry-After header telling the client
+// how many seconds to wait, once a client IP has used up its tokens. Every response carries
+// X-RateLimit-Limit, the burst size, X-RateLimit-Remaining, the requests the client can still
+// make right away, and X-RateLimit-Reset, the seconds until its bucket is full again.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter := rl.limiter(rl.clientIP(r))
+		reservation := limiter.Reserve()
+		if !reservation.OK() {
+			writeRateLimitError(w, r, rl.state(limiter))
+			return
+		}
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeRateLimitError(w, r, rl.state(limiter))
+			return
+		}
+		rl.state(limiter).setHeaders(w)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// state reports how much of limiter's bucket is left.
+func (rl *RateLimiter) state(limiter *rate.Limiter) *RateLimitError {
+	tokens := math.Max(limiter.Tokens(), 0)
+	state := &RateLimitError{Limit: limiter.Burst(), Remaining: int(tokens)}
+	if missing := float64(limiter.Burst()) - tokens; missing > 0 && rl.limit > 0 {
+		state.Reset = int(math.Ceil(missing / float64(rl.limit)))
+	}
+	return state
+}
+
+// setHeaders writes the X-RateLimit-* headers.
+func (e *RateLimitError) setHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(e.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(e.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(e.Reset))
+}
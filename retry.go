@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RetryPolicy retries read queries that fail with a transient database error. Writes are
+// never retried automatically: a transaction that failed part way is for the client to retry.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, including the first one.
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry; it doubles before every following retry.
+	BaseDelay time.Duration
+}
+
+// readRetry is the policy for read queries, set from DB_RETRY_MAX_ATTEMPTS and
+// DB_RETRY_BASE_DELAY at startup.
+var readRetry = RetryPolicy{MaxAttempts: 3, BaseDelay: 50 * time.Millisecond}
+
+// Do calls fn until it succeeds, fails with an error that is not transient, or MaxAttempts
+// is reached. It stops waiting between attempts as soon as ctx is done.
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	delay := p.BaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !isTransient(err) {
+			return err
+		}
+		slog.DebugContext(ctx, "retrying transient database error", "attempt", attempt, "delay", delay.String(), "error", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// isTransient reports whether err is a database error that may not happen again: a
+// serialization failure, a deadlock, or a lost or refused connection.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code == "40001", pqErr.Code == "40P01":
+			return true
+		case pqErr.Code.Class() == "08":
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.As(err, &netErr)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SearchResult is a product matched by a search along with the score it was ranked by.
+type SearchResult struct {
+	Product
+	Score float64 `json:"score"`
+}
+
+// searchRankings lists the accepted values of the ?rank= search parameter.
+var searchRankings = map[string]bool{
+	"relevance":  true,
+	"popularity": true,
+	"blended":    true,
+}
+
+// likeEscaper escapes the LIKE metacharacters so they match literally with ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// escapeLike escapes s for use inside a LIKE pattern.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// searchScoreExpr returns the SQL expression used to score a search match for the given
+// ranking. The expression expects the search text as $1, the same text escaped with
+// escapeLike as $2, and the Products table as "p".
+//
+// The components are each scaled to [0, 1]:
+//
+//	relevance  = 1.0 for an exact title match, 0.75 for a title prefix match, 0.5 otherwise
+//	popularity = boughtInLastMonth / max(boughtInLastMonth) over all matches
+//	blended    = 0.7 * relevance + 0.3 * popularity
+func searchScoreExpr(rank string) (string, error) {
+	const relevance = `(CASE WHEN lower(p."title") = lower($1) THEN 1.0 WHEN lower(p."title") LIKE lower($2) || '%' ESCAPE '\' THEN 0.75 ELSE 0.5 END)`
+	const popularity = `(COALESCE(p."boughtInLastMonth"::float8 / NULLIF(MAX(p."boughtInLastMonth") OVER (), 0), 0))`
+
+	switch rank {
+	case "relevance":
+		return relevance, nil
+	case "popularity":
+		return popularity, nil
+	case "blended":
+		return "(0.7 * " + relevance + " + 0.3 * " + popularity + ")", nil
+	}
+	return "", fmt.Errorf("unknown rank %q", rank)
+}
+
+// searchProducts retrieves products whose title contains query and that match filter,
+// highest score first.
+// The query is matched literally, so % and _ are not treated as wildcards. When withStock
+// is set each result also carries its available unit count.
+func searchProducts(ctx context.Context, db *sql.DB, query, rank string, filter ProductFilter, limit int, withStock bool) ([]SearchResult, error) {
+	score, err := searchScoreExpr(rank)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, join := productColumns, ""
+	if withStock {
+		columns, join = productColumns+", "+stockColumn, stockJoin
+	}
+
+	// $1 and $2 are referenced by the score expression
+	where := whereBuilder{args: []interface{}{query, escapeLike(query)}}
+	where.add(`p."title" ILIKE '%' || $2 || '%' ESCAPE '\'`)
+	filter.apply(&where)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+columns+`, `+score+` AS "score"
+		FROM "Products" p`+join+where.clause()+`
+		ORDER BY "score" DESC, p."asin"
+		LIMIT `+where.bind(limit), where.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]SearchResult, 0)
+	for rows.Next() {
+		var result SearchResult
+		dest := result.scanDest()
+		if withStock {
+			result.Available = new(int)
+			dest = append(dest, result.Available)
+		}
+		if err := rows.Scan(append(dest, &result.Score)...); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// searchDocument is the text searched by fullTextSearch. It matches the expression of the
+// "Products_search_idx" index, see migrations/009_products_search.sql.
+const searchDocument = `to_tsvector('english', coalesce(p."title", '') || ' ' || coalesce(p."categoryName", ''))`
+
+// fullTextSearch retrieves products whose title or category matches query, best match first.
+// The query uses web search syntax: words are ANDed, "quoted phrases" match in order, "or"
+// separates alternatives and a leading - excludes a word. A non-empty category restricts the
+// results to that category. When withStock is set each result also carries its available
+// unit count.
+func fullTextSearch(ctx context.Context, db *sql.DB, query, category string, filter ProductFilter, limit, offset int, withStock bool) ([]SearchResult, error) {
+	columns, join := productColumns, ""
+	if withStock {
+		columns, join = productColumns+", "+stockColumn, stockJoin
+	}
+
+	// $1 is referenced by the score expression
+	where := whereBuilder{args: []interface{}{query}}
+	where.add(searchDocument + " @@ websearch_to_tsquery('english', $1)")
+	if category != "" {
+		where.add("lower(p.\"categoryName\") = lower(?)", category)
+	}
+	filter.apply(&where)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+columns+`, ts_rank_cd(`+searchDocument+`, websearch_to_tsquery('english', $1)) AS "score"
+		FROM "Products" p`+join+where.clause()+`
+		ORDER BY "score" DESC, p."asin"
+		LIMIT `+where.bind(limit)+` OFFSET `+where.bind(offset), where.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]SearchResult, 0)
+	for rows.Next() {
+		var result SearchResult
+		dest := result.scanDest()
+		if withStock {
+			result.Available = new(int)
+			dest = append(dest, result.Available)
+		}
+		if err := rows.Scan(append(dest, &result.Score)...); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// withQueryTimeout bounds every request's context by timeout, so database queries run
+// with r.Context() are cancelled instead of hanging when Postgres is slow. writeError
+// turns the resulting failures into 503 Service Unavailable.
+func withQueryTimeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
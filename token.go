@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenIssuer signs and verifies the HS256 JWTs handed out on login. The token's subject is
+// the user ID.
+type TokenIssuer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewTokenIssuer returns a TokenIssuer signing with secret. An empty secret is replaced by a
+// random one, so tokens stop being valid when the process restarts.
+func NewTokenIssuer(secret string, ttl time.Duration) *TokenIssuer {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic("crypto/rand: " + err.Error())
+		}
+	}
+	return &TokenIssuer{secret: key, ttl: ttl}
+}
+
+// Issue returns a signed token for userID and when it expires.
+func (t *TokenIssuer) Issue(userID string) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(t.ttl)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   userID,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expires),
+	})
+	signed, err := token.SignedString(t.secret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expires, nil
+}
+
+// Verify checks the token's signature and expiry and returns its user ID.
+func (t *TokenIssuer) Verify(token string) (string, error) {
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return t.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return "", err
+	}
+	if claims.Subject == "" {
+		return "", errors.New("token has no subject")
+	}
+	return claims.Subject, nil
+}
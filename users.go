@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Credentials is the body of POST /register and POST /login.
+type Credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// AuthResponse carries the token a client sends as "Authorization: Bearer <token>".
+type AuthResponse struct {
+	UserID    string    `json:"userId"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// validate normalizes the email and checks both fields. Passwords are limited to 72 bytes,
+// the most bcrypt uses.
+func (c *Credentials) validate() error {
+	c.Email = strings.TrimSpace(c.Email)
+	if address, err := mail.ParseAddress(c.Email); err != nil || address.Address != c.Email {
+		return ErrInvalidEmail
+	}
+	if len(c.Password) < 8 || len(c.Password) > 72 {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// createUserAttempts bounds how many generated user IDs createUser tries before giving up.
+const createUserAttempts = 3
+
+// createUser registers a user with a bcrypt hash of the password and returns the new user's
+// ID. It returns ErrUserExists when the email is already registered, in any letter case. A
+// generated ID that is already taken is replaced by a fresh one.
+func createUser(ctx context.Context, db *sql.DB, email, password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	for attempt := 1; ; attempt++ {
+		userID := GenerateRandomUserID()
+		_, err = db.ExecContext(ctx, "INSERT INTO \"Users\" (\"UserId\", \"Email\", \"PasswordHash\") VALUES ($1, $2, $3)",
+			userID, email, string(hash))
+		switch constraint := uniqueViolation(err); {
+		case err == nil:
+			return userID, nil
+		case constraint == "Users_Email_idx":
+			return "", ErrUserExists
+		case constraint == "Users_pkey" && attempt < createUserAttempts:
+			continue
+		default:
+			return "", err
+		}
+	}
+}
+
+// uniqueViolation returns the name of the unique constraint or index err violates, or "" when
+// err is not a unique violation.
+func uniqueViolation(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return pqErr.Constraint
+	}
+	return ""
+}
+
+// dummyPasswordHash is compared against when the email is unknown, so a login takes as long
+// whether or not the account exists.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// authenticateUser returns the ID of the user with this email and password. It returns
+// ErrInvalidCredentials for an unknown email or a wrong password alike.
+func authenticateUser(ctx context.Context, db *sql.DB, email, password string) (string, error) {
+	var userID, hash string
+	err := db.QueryRowContext(ctx, "SELECT \"UserId\", \"PasswordHash\" FROM \"Users\" WHERE lower(\"Email\") = lower($1)",
+		strings.TrimSpace(email)).Scan(&userID, &hash)
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return "", ErrInvalidCredentials
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return "", ErrInvalidCredentials
+	}
+	return userID, nil
+}
+
+// isRegisteredUser reports whether userID belongs to an account rather than a guest.
+func isRegisteredUser(ctx context.Context, db *sql.DB, userID string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM \"Users\" WHERE \"UserId\" = $1)", userID).Scan(&exists)
+	return exists, err
+}